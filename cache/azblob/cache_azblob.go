@@ -0,0 +1,217 @@
+package azblob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/simse/ccmd/internal"
+)
+
+// archives are uploaded as block blobs in blocks of this size, several at a
+// time
+const (
+	blockSize        = 8 * 1024 * 1024
+	blockConcurrency = 4
+)
+
+// azuriteConnectionString is what UseDevelopmentStorage=true stands for, the
+// well-known account of the Azurite emulator.
+const azuriteConnectionString = "DefaultEndpointsProtocol=http;" +
+	"AccountName=devstoreaccount1;" +
+	"AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;" +
+	"BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;"
+
+// AzureCache stores entries as block blobs in an Azure Blob Storage
+// container, named in the URI as azblob://account/container.
+//
+// Credentials are taken from AZURE_STORAGE_CONNECTION_STRING, then
+// AZURE_STORAGE_SAS_TOKEN, and otherwise found by DefaultAzureCredential,
+// which covers service principals, workload and managed identity, and the
+// Azure CLI.
+type AzureCache struct {
+	URI string
+
+	Account   string
+	Container string
+
+	Client *azblob.Client // tests inject, otherwise we build one
+}
+
+var (
+	accountPattern   = regexp.MustCompile(`^[a-z0-9]{3,24}$`)
+	containerPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{1,61})[a-z0-9]$`)
+)
+
+func (a *AzureCache) Validate() error {
+	// 1. Account names are 3–24 lowercase letters and numbers
+	if !accountPattern.MatchString(a.GetAccountName()) {
+		return errors.New("storage account name must be between 3 and 24 characters and contain only lowercase letters and numbers")
+	}
+
+	container := a.GetContainerName()
+
+	// 2. Container names are 3–63 lowercase letters, numbers and hyphens,
+	// beginning and ending with a letter or number
+	if !containerPattern.MatchString(container) {
+		return errors.New("container name must be between 3 and 63 characters, contain only lowercase letters, numbers and hyphens, and begin and end with a letter or number")
+	}
+
+	// 3. No two adjacent hyphens
+	if strings.Contains(container, "--") {
+		return errors.New("container name must not contain consecutive hyphens")
+	}
+
+	return nil
+}
+
+func (a *AzureCache) GetAccountName() string {
+	return a.Account
+}
+
+func (a *AzureCache) GetContainerName() string {
+	return a.Container
+}
+
+func (a *AzureCache) getClient() (*azblob.Client, error) {
+	if a.Client != nil {
+		return a.Client, nil
+	}
+
+	serviceURL := fmt.Sprintf("https://%s.blob.core.windows.net/", a.GetAccountName())
+
+	var client *azblob.Client
+	var err error
+
+	switch {
+	case os.Getenv("AZURE_STORAGE_CONNECTION_STRING") != "":
+		connectionString := os.Getenv("AZURE_STORAGE_CONNECTION_STRING")
+		if strings.EqualFold(strings.TrimSuffix(connectionString, ";"), "UseDevelopmentStorage=true") {
+			connectionString = azuriteConnectionString
+		}
+
+		// the connection string names its own account, which must not
+		// silently replace the one in the URI
+		if account := connectionStringAccount(connectionString); account != "" && !strings.EqualFold(account, a.GetAccountName()) {
+			return nil, fmt.Errorf("AZURE_STORAGE_CONNECTION_STRING is for account %q, but the URI names account %q", account, a.GetAccountName())
+		}
+		client, err = azblob.NewClientFromConnectionString(connectionString, nil)
+
+	case os.Getenv("AZURE_STORAGE_SAS_TOKEN") != "":
+		sas := strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+		client, err = azblob.NewClientWithNoCredential(serviceURL+"?"+sas, nil)
+
+	default:
+		var cred *azidentity.DefaultAzureCredential
+		cred, err = azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, err
+		}
+		client, err = azblob.NewClient(serviceURL, cred, nil)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	a.Client = client
+	return a.Client, nil
+}
+
+// connectionStringAccount returns the AccountName of a connection string, or
+// an empty string if it has none, e.g. when it only holds a SAS.
+func connectionStringAccount(connectionString string) string {
+	for _, part := range strings.Split(connectionString, ";") {
+		key, value, _ := strings.Cut(part, "=")
+		if strings.EqualFold(strings.TrimSpace(key), "AccountName") {
+			return strings.TrimSpace(value)
+		}
+	}
+
+	return ""
+}
+
+func (a *AzureCache) GetFriendlyName() string {
+	return "azure blob"
+}
+
+func (a *AzureCache) GetEntry(key string) (io.ReadCloser, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := client.DownloadStream(context.TODO(), a.GetContainerName(), key, nil)
+	if err != nil {
+		return nil, a.apiError(err, key)
+	}
+
+	return output.Body, nil
+}
+
+// Has checks for an entry by fetching its properties.
+func (a *AzureCache) Has(key string) (bool, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return false, err
+	}
+
+	blobClient := client.ServiceClient().NewContainerClient(a.GetContainerName()).NewBlobClient(key)
+	if _, err := blobClient.GetProperties(context.TODO(), nil); err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return false, nil
+		}
+		return false, a.apiError(err, key)
+	}
+
+	return true, nil
+}
+
+func (a *AzureCache) PutEntry(key string, body io.Reader) (int64, error) {
+	client, err := a.getClient()
+	if err != nil {
+		return 0, err
+	}
+
+	// blocks are only committed once every one of them has been staged, so
+	// a failed upload leaves no blob behind
+	counter := &internal.CountingReader{Reader: body}
+	contentType := "application/gzip"
+	if _, err := client.UploadStream(context.TODO(), a.GetContainerName(), key, counter, &azblob.UploadStreamOptions{
+		BlockSize:   blockSize,
+		Concurrency: blockConcurrency,
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType},
+	}); err != nil {
+		return 0, a.apiError(err, key)
+	}
+
+	return counter.ByteCount, nil
+}
+
+func (a *AzureCache) apiError(err error, key string) error {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return err
+	}
+
+	switch {
+	case bloberror.HasCode(err, bloberror.ContainerNotFound):
+		return fmt.Errorf("container %q does not exist in account %q", a.GetContainerName(), a.GetAccountName())
+	case bloberror.HasCode(err, bloberror.BlobNotFound):
+		return fmt.Errorf("blob %q not found in container %q", key, a.GetContainerName())
+	case respErr.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("access denied to container %q: %s", a.GetContainerName(), respErr.ErrorCode)
+	default:
+		return fmt.Errorf("Azure API error %s: %s", respErr.ErrorCode, http.StatusText(respErr.StatusCode))
+	}
+}
@@ -0,0 +1,274 @@
+package azblob
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+)
+
+// fakeBlobService is an in-memory Blob service that understands just enough
+// of the REST API for downloads and block uploads
+type fakeBlobService struct {
+	mu         sync.Mutex
+	containers map[string]map[string][]byte
+	staged     map[string][]byte
+	denied     bool
+}
+
+func newFakeBlobService() *fakeBlobService {
+	return &fakeBlobService{
+		containers: map[string]map[string][]byte{"mycontainer": {}},
+		staged:     map[string][]byte{},
+	}
+}
+
+func (f *fakeBlobService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.denied {
+		fail(w, http.StatusForbidden, "AuthorizationFailure")
+		return
+	}
+
+	// /{account}/{container}/{blob}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) != 3 {
+		fail(w, http.StatusBadRequest, "InvalidUri")
+		return
+	}
+
+	blobs, ok := f.containers[parts[1]]
+	if !ok {
+		fail(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	name := parts[2]
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodHead:
+		data, ok := blobs[name]
+		if !ok {
+			fail(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == http.MethodGet:
+		data, ok := blobs[name]
+		if !ok {
+			fail(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+
+	case r.Method == http.MethodPut && query.Get("comp") == "":
+		blobs[name], _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		data, _ := io.ReadAll(r.Body)
+		f.staged[name+"/"+query.Get("blockid")] = data
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			fail(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+
+		var blob []byte
+		for _, id := range list.Latest {
+			blob = append(blob, f.staged[name+"/"+id]...)
+		}
+		blobs[name] = blob
+		w.WriteHeader(http.StatusCreated)
+
+	default:
+		fail(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+func fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+}
+
+func newTestCache(t *testing.T, fake *fakeBlobService, container string) *AzureCache {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	connectionString := strings.Replace(azuriteConnectionString, "http://127.0.0.1:10000", server.URL, 1)
+	client, err := azblob.NewClientFromConnectionString(connectionString, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &AzureCache{Account: "devstoreaccount1", Container: container, Client: client}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		account   string
+		container string
+		wantErr   bool
+	}{
+		{"myaccount", "mycontainer", false},
+		{"myaccount", "my-container", false},
+
+		{"myaccount", "", true},
+		{"my-account", "mycontainer", true},
+		{"ab", "mycontainer", true},
+		{"myaccount", "MyContainer", true},
+		{"myaccount", "my--container", true},
+		{"myaccount", "-container", true},
+		{"myaccount", "mycontainer/prefix", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.account+"/"+tc.container, func(t *testing.T) {
+			err := (&AzureCache{Account: tc.account, Container: tc.container}).Validate()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Validate(%q, %q) err=%v, wantErr=%v", tc.account, tc.container, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestConnectionStringAccount(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_CONNECTION_STRING", "UseDevelopmentStorage=true")
+
+	if _, err := (&AzureCache{Account: "devstoreaccount1", Container: "mycontainer"}).getClient(); err != nil {
+		t.Errorf("getClient returned error for the emulator's own account: %v", err)
+	}
+
+	_, err := (&AzureCache{Account: "otheraccount", Container: "mycontainer"}).getClient()
+	if err == nil || err.Error() != `AZURE_STORAGE_CONNECTION_STRING is for account "devstoreaccount1", but the URI names account "otheraccount"` {
+		t.Errorf("err = %v; want an account mismatch", err)
+	}
+
+	if got := connectionStringAccount("BlobEndpoint=https://x.blob.core.windows.net/;SharedAccessSignature=sv=1"); got != "" {
+		t.Errorf("account of a SAS connection string = %q; want none", got)
+	}
+}
+
+func TestPutEntryAndGetEntry(t *testing.T) {
+	fake := newFakeBlobService()
+	a := newTestCache(t, fake, "mycontainer")
+
+	// large enough to be uploaded in several blocks
+	data := bytes.Repeat([]byte("0123456789abcdef"), blockSize/16*2+100)
+
+	n, err := a.PutEntry("mykey", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("PutEntry returned error: %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("bytes = %d; want %d", n, len(data))
+	}
+	if len(fake.staged) != 3 {
+		t.Errorf("staged %d blocks; want 3", len(fake.staged))
+	}
+
+	rc, err := a.GetEntry("mykey")
+	if err != nil {
+		t.Fatalf("GetEntry returned error: %v", err)
+	}
+	defer rc.Close()
+
+	got, _ := io.ReadAll(rc)
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded %d bytes that do not match the %d uploaded", len(got), len(data))
+	}
+}
+
+func TestHas(t *testing.T) {
+	fake := newFakeBlobService()
+	a := newTestCache(t, fake, "mycontainer")
+
+	if ok, err := a.Has("mykey"); err != nil || ok {
+		t.Errorf("Has before PutEntry = %v, %v; want false", ok, err)
+	}
+
+	if _, err := a.PutEntry("mykey", bytes.NewBufferString("hello")); err != nil {
+		t.Fatalf("PutEntry returned error: %v", err)
+	}
+
+	if ok, err := a.Has("mykey"); err != nil || !ok {
+		t.Errorf("Has after PutEntry = %v, %v; want true", ok, err)
+	}
+
+	fake.denied = true
+	if _, err := a.Has("mykey"); err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("err = %v; want access denied", err)
+	}
+}
+
+func TestGetEntryErrors(t *testing.T) {
+	cases := []struct {
+		name      string
+		container string
+		denied    bool
+		wantErr   string
+	}{
+		{"missing key", "mycontainer", false, `blob "mykey" not found in container "mycontainer"`},
+		{"missing container", "othercontainer", false, `container "othercontainer" does not exist in account "devstoreaccount1"`},
+		{"denied", "mycontainer", true, `access denied to container "mycontainer": AuthorizationFailure`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := newFakeBlobService()
+			fake.denied = tc.denied
+			a := newTestCache(t, fake, tc.container)
+
+			_, err := a.GetEntry("mykey")
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("got=%v, want=%v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("disk on fire")
+}
+
+func TestPutEntryErrors(t *testing.T) {
+	fake := newFakeBlobService()
+
+	missing := newTestCache(t, fake, "othercontainer")
+	n, err := missing.PutEntry("mykey", bytes.NewBufferString("hello"))
+	if err == nil || err.Error() != `container "othercontainer" does not exist in account "devstoreaccount1"` {
+		t.Fatalf("expected missing container, got %v", err)
+	}
+	if n != 0 {
+		t.Errorf("on error, count should be 0, got %d", n)
+	}
+
+	a := newTestCache(t, fake, "mycontainer")
+	if _, err := a.PutEntry("mykey", failingReader{}); err == nil {
+		t.Fatal("expected the read error")
+	}
+	if _, err := a.GetEntry("mykey"); err == nil {
+		t.Error("a failed upload must not leave a blob behind")
+	}
+}
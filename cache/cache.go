@@ -2,10 +2,17 @@ package cache
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"os"
 	"strings"
 
+	"github.com/simse/ccmd/cache/azblob"
+	"github.com/simse/ccmd/cache/gcs"
+	"github.com/simse/ccmd/cache/http"
+	"github.com/simse/ccmd/cache/redis"
 	"github.com/simse/ccmd/cache/s3"
+	"github.com/simse/ccmd/cache/sftp"
 	"github.com/simse/ccmd/internal"
 	"github.com/spf13/afero"
 )
@@ -13,18 +20,99 @@ import (
 type CacheProvider interface {
 	GetEntry(string) (io.ReadCloser, error)
 	PutEntry(string, io.Reader) (int64, error)
+	Has(string) (bool, error)
 	GetFriendlyName() string
 	Validate() error
 }
 
-func GetCacheProviderFromURI(uri string) (CacheProvider, error) {
-	if strings.HasPrefix(uri, "s3://") {
-		return &s3.S3Cache{URI: uri}, nil
+// MetadataPutter is implemented by providers that can store metadata, such
+// as the command and how long it took, alongside an entry.
+type MetadataPutter interface {
+	PutEntryWithMetadata(key string, body io.Reader, metadata map[string]string) (int64, error)
+}
+
+// AccessChecker is implemented by providers that can find out up front
+// whether their credentials allow reading and writing entries. An error means
+// the backend cannot be used at all, e.g. because the bucket does not exist.
+type AccessChecker interface {
+	CheckAccess() (read internal.Access, write internal.Access, err error)
+}
+
+// PutEntry stores body under key, with metadata if the provider supports it.
+func PutEntry(provider CacheProvider, key string, body io.Reader, metadata map[string]string) (int64, error) {
+	if putter, ok := provider.(MetadataPutter); ok && len(metadata) > 0 {
+		return putter.PutEntryWithMetadata(key, body, metadata)
+	}
+
+	return provider.PutEntry(key, body)
+}
+
+func init() {
+	Register("s3", func(config Config) (CacheProvider, error) {
+		if config.Host == "" {
+			return nil, errors.New("URI must name a bucket, e.g. s3://bucket/prefix")
+		}
+		return &s3.S3Cache{URI: config.URI, Bucket: config.Host, Prefix: config.Path, Query: config.Query}, nil
+	})
+
+	Register("gs", func(config Config) (CacheProvider, error) {
+		if config.Host == "" {
+			return nil, errors.New("URI must name a bucket, e.g. gs://bucket")
+		}
+		if config.Path != "" && config.Path != "/" {
+			return nil, errors.New("URI must not include a path")
+		}
+		for param := range config.Query {
+			if param != "endpoint" {
+				return nil, fmt.Errorf("unknown parameter %q", param)
+			}
+		}
+		return &gcs.GCSCache{URI: config.URI, Bucket: config.Host, Endpoint: config.Query.Get("endpoint")}, nil
+	})
+
+	Register("azblob", func(config Config) (CacheProvider, error) {
+		container := strings.Trim(config.Path, "/")
+		if config.Host == "" || strings.Contains(container, "/") {
+			return nil, errors.New("URI must be of the form azblob://account/container")
+		}
+		if len(config.Query) > 0 || config.Fragment != "" {
+			return nil, errors.New("URI must not include a query or fragment")
+		}
+		return &azblob.AzureCache{URI: config.URI, Account: config.Host, Container: container}, nil
+	})
+
+	// the Redis client and HTTP requests take the whole URL
+	redisFactory := func(config Config) (CacheProvider, error) {
+		return &redis.RedisCache{URI: config.URI}, nil
 	}
+	Register("redis", redisFactory)
+	Register("rediss", redisFactory)
+
+	Register("sftp", func(config Config) (CacheProvider, error) {
+		if config.Host == "" {
+			return nil, errors.New("URI must include a host")
+		}
+		if _, hasPassword := config.User.Password(); hasPassword {
+			return nil, errors.New("passwords are not supported, use an ssh-agent or key")
+		}
+		if len(config.Query) > 0 || config.Fragment != "" {
+			return nil, errors.New("URI must not include a query or fragment")
+		}
+		return &sftp.SFTPCache{URI: config.URI, User: config.User.Username(), Host: config.Host, Path: config.Path}, nil
+	})
 
-	if strings.HasPrefix(uri, "local://") {
-		return &internal.LocalCache{URI: uri, FS: afero.NewOsFs()}, nil
+	httpFactory := func(config Config) (CacheProvider, error) {
+		return &http.HTTPCache{URI: config.URI, Token: os.Getenv("CCMD_HTTP_TOKEN")}, nil
 	}
+	Register("http", httpFactory)
+	Register("https", httpFactory)
 
-	return nil, errors.New("unsupported cache provider")
+	Register("local", func(config Config) (CacheProvider, error) {
+		dir := config.Host + config.Path
+		if config.Query == nil {
+			// not a valid URL, e.g. a Windows path, so taken as it is
+			_, dir, _ = strings.Cut(config.URI, "://")
+		}
+		return &internal.LocalCache{URI: config.URI, Dir: dir, FS: afero.NewOsFs()}, nil
+	})
 }
@@ -0,0 +1,172 @@
+package gcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	"github.com/simse/ccmd/internal"
+)
+
+// GCSCache stores entries as objects in a Google Cloud Storage bucket, named
+// in the URI as gs://bucket. Credentials are found with Application Default
+// Credentials, and an endpoint can be given as gs://bucket?endpoint=URL, e.g.
+// to use fake-gcs-server. STORAGE_EMULATOR_HOST is honoured as well.
+type GCSCache struct {
+	URI string
+
+	Bucket   string
+	Endpoint string // empty for the public endpoint
+
+	Client *storage.Client // tests inject, otherwise we build one
+}
+
+var bucketPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*[a-z0-9]$`)
+
+func (g *GCSCache) Validate() error {
+	name := g.GetBucketName()
+
+	// 1. Length 3–222, with dot separated components of at most 63
+	if n := len(name); n < 3 || n > 222 {
+		return fmt.Errorf("bucket name must be between 3 and 222 characters; got %d", n)
+	}
+	for _, component := range strings.Split(name, ".") {
+		if len(component) > 63 {
+			return errors.New("each dot separated part of a bucket name must be at most 63 characters")
+		}
+	}
+
+	// 2. Only lowercase letters, numbers, periods, hyphens, underscores, and
+	// must begin and end with a letter or number
+	if !bucketPattern.MatchString(name) {
+		return errors.New("bucket name can contain only lowercase letters, numbers, periods, hyphens and underscores, and must begin and end with a letter or number")
+	}
+
+	// 3. Not formatted as IP address (e.g. 192.168.5.4)
+	if net.ParseIP(name) != nil {
+		return errors.New("bucket name must not be formatted as an IP address")
+	}
+
+	// 4. Reserved names
+	if strings.HasPrefix(name, "goog") || strings.Contains(name, "google") {
+		return errors.New(`bucket name must not start with "goog" or contain "google"`)
+	}
+
+	return nil
+}
+
+func (g *GCSCache) GetBucketName() string {
+	return g.Bucket
+}
+
+func (g *GCSCache) getClient() (*storage.Client, error) {
+	if g.Client == nil {
+		var opts []option.ClientOption
+		if g.Endpoint != "" {
+			opts = append(opts, option.WithEndpoint(g.Endpoint))
+		}
+
+		client, err := storage.NewClient(context.TODO(), opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		g.Client = client
+	}
+
+	return g.Client, nil
+}
+
+func (g *GCSCache) GetFriendlyName() string {
+	return "gcs"
+}
+
+func (g *GCSCache) GetEntry(key string) (io.ReadCloser, error) {
+	client, err := g.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := client.Bucket(g.GetBucketName()).Object(key).NewReader(context.TODO())
+	if err != nil {
+		return nil, g.apiError(err, key)
+	}
+
+	return reader, nil
+}
+
+// Has checks for an entry by fetching its attributes.
+func (g *GCSCache) Has(key string) (bool, error) {
+	client, err := g.getClient()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = client.Bucket(g.GetBucketName()).Object(key).Attrs(context.TODO())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, g.apiError(err, key)
+	}
+
+	return true, nil
+}
+
+func (g *GCSCache) PutEntry(key string, body io.Reader) (int64, error) {
+	client, err := g.getClient()
+	if err != nil {
+		return 0, err
+	}
+
+	// cancelling the context aborts the upload, so a failed read never
+	// leaves a truncated object behind
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	writer := client.Bucket(g.GetBucketName()).Object(key).NewWriter(ctx)
+	writer.ContentType = "application/gzip"
+
+	counter := &internal.CountingReader{Reader: body}
+	if _, err := io.Copy(writer, counter); err != nil {
+		cancel()
+		writer.Close()
+		return 0, g.apiError(err, key)
+	}
+
+	if err := writer.Close(); err != nil {
+		return 0, g.apiError(err, key)
+	}
+
+	return counter.ByteCount, nil
+}
+
+func (g *GCSCache) apiError(err error, key string) error {
+	if errors.Is(err, storage.ErrBucketNotExist) {
+		return fmt.Errorf("bucket %q does not exist", g.GetBucketName())
+	}
+
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("object %q not found in bucket %q", key, g.GetBucketName())
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		// uploads only get a 404 when the bucket is missing
+		if apiErr.Code == http.StatusNotFound {
+			return fmt.Errorf("bucket %q does not exist", g.GetBucketName())
+		}
+		return fmt.Errorf("GCS API error %d: %s", apiErr.Code, apiErr.Message)
+	}
+
+	return err
+}
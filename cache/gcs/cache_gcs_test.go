@@ -0,0 +1,144 @@
+package gcs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+)
+
+func newFakeServer(t *testing.T) *fakestorage.Server {
+	t.Helper()
+	server, err := fakestorage.NewServerWithOptions(fakestorage.Options{NoListener: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.CreateBucketWithOpts(fakestorage.CreateBucketOpts{Name: "mybucket"})
+	t.Cleanup(server.Stop)
+	return server
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		bucket  string
+		wantErr bool
+	}{
+		{"my-bucket", false},
+		{"my_bucket.example.com", false},
+
+		{"ab", true},
+		{"MyBucket", true},
+		{"-bucket", true},
+		{"192.168.5.4", true},
+		{"goog-bucket", true},
+		{"my-google-bucket", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.bucket, func(t *testing.T) {
+			err := (&GCSCache{Bucket: tc.bucket}).Validate()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Validate(%q) err=%v, wantErr=%v", tc.bucket, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPutEntryAndGetEntry(t *testing.T) {
+	server := newFakeServer(t)
+	g := &GCSCache{Bucket: "mybucket", Client: server.Client()}
+
+	n, err := g.PutEntry("mykey", bytes.NewBufferString("hello"))
+	if err != nil {
+		t.Fatalf("PutEntry returned error: %v", err)
+	}
+	if n != 5 {
+		t.Errorf("bytes = %d; want 5", n)
+	}
+
+	rc, err := g.GetEntry("mykey")
+	if err != nil {
+		t.Fatalf("GetEntry returned error: %v", err)
+	}
+	defer rc.Close()
+
+	data, _ := io.ReadAll(rc)
+	if string(data) != "hello" {
+		t.Errorf("data = %q; want %q", data, "hello")
+	}
+}
+
+func TestHas(t *testing.T) {
+	server := newFakeServer(t)
+	g := &GCSCache{Bucket: "mybucket", Client: server.Client()}
+
+	if ok, err := g.Has("mykey"); err != nil || ok {
+		t.Errorf("Has before PutEntry = %v, %v; want false", ok, err)
+	}
+
+	if _, err := g.PutEntry("mykey", bytes.NewBufferString("hello")); err != nil {
+		t.Fatalf("PutEntry returned error: %v", err)
+	}
+
+	if ok, err := g.Has("mykey"); err != nil || !ok {
+		t.Errorf("Has after PutEntry = %v, %v; want true", ok, err)
+	}
+}
+
+func TestGetEntryErrors(t *testing.T) {
+	server := newFakeServer(t)
+
+	cases := []struct {
+		name    string
+		bucket  string
+		wantErr string
+	}{
+		{"missing key", "mybucket", `object "mykey" not found in bucket "mybucket"`},
+		{"missing bucket", "otherbucket", `object "mykey" not found in bucket "otherbucket"`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &GCSCache{Bucket: tc.bucket, Client: server.Client()}
+
+			_, err := g.GetEntry("mykey")
+			if err == nil || err.Error() != tc.wantErr {
+				t.Fatalf("got=%v, want=%v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPutEntryMissingBucket(t *testing.T) {
+	server := newFakeServer(t)
+	g := &GCSCache{Bucket: "otherbucket", Client: server.Client()}
+
+	n, err := g.PutEntry("mykey", bytes.NewBufferString("hello"))
+	if err == nil || err.Error() != `bucket "otherbucket" does not exist` {
+		t.Fatalf("expected missing bucket, got %v", err)
+	}
+	if n != 0 {
+		t.Errorf("on error, count should be 0, got %d", n)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("disk on fire")
+}
+
+func TestPutEntryReadError(t *testing.T) {
+	server := newFakeServer(t)
+	g := &GCSCache{Bucket: "mybucket", Client: server.Client()}
+
+	if _, err := g.PutEntry("mykey", failingReader{}); err == nil {
+		t.Fatal("expected the read error")
+	}
+
+	if _, err := g.GetEntry("mykey"); err == nil {
+		t.Error("a failed upload must not leave an object behind")
+	}
+}
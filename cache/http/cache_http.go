@@ -0,0 +1,154 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// HTTPCache stores entries on a server speaking the Bazel HTTP remote cache
+// protocol, e.g. bazel-remote or nginx with WebDAV enabled. Entries are kept
+// in the action cache at {URI}/ac/{sha256 of key}, since Bazel servers only
+// accept SHA-256 digests as keys.
+type HTTPCache struct {
+	URI    string
+	Token  string       // sent as a bearer token when set
+	Client *http.Client // tests inject, otherwise http.DefaultClient
+}
+
+func (h *HTTPCache) Validate() error {
+	u, err := url.Parse(h.URI)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q, expected http or https", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return errors.New("URI must include a host")
+	}
+
+	if u.RawQuery != "" || u.Fragment != "" {
+		return errors.New("URI must not include a query or fragment")
+	}
+
+	return nil
+}
+
+func (h *HTTPCache) GetFriendlyName() string {
+	return "http"
+}
+
+// EntryURL is where the entry for key is stored.
+func (h *HTTPCache) EntryURL(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return strings.TrimSuffix(h.URI, "/") + "/ac/" + hex.EncodeToString(digest[:])
+}
+
+func (h *HTTPCache) getClient() *http.Client {
+	if h.Client == nil {
+		return http.DefaultClient
+	}
+	return h.Client
+}
+
+func (h *HTTPCache) GetEntry(key string) (io.ReadCloser, error) {
+	res, err := h.do(http.MethodGet, key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, statusError(res, key)
+	}
+
+	return res.Body, nil
+}
+
+// Has checks for an entry with a HEAD request.
+func (h *HTTPCache) Has(key string) (bool, error) {
+	res, err := h.do(http.MethodHead, key, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, statusError(res, key)
+	}
+}
+
+func (h *HTTPCache) PutEntry(key string, body io.Reader) (int64, error) {
+	// not every server accepts chunked uploads, so the size must be known
+	// up front
+	spool, err := os.CreateTemp("", "ccmd-upload-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	size, err := io.Copy(spool, body)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	res, err := h.do(http.MethodPut, key, io.NopCloser(spool), size)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return 0, statusError(res, key)
+	}
+
+	return size, nil
+}
+
+func (h *HTTPCache) do(method string, key string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, h.EntryURL(key), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+
+	return h.getClient().Do(req)
+}
+
+func statusError(res *http.Response, key string) error {
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return fmt.Errorf("entry %q not found", key)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("access denied by server: %s", res.Status)
+	default:
+		return fmt.Errorf("unexpected response from server: %s", res.Status)
+	}
+}
@@ -0,0 +1,243 @@
+package http
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Store is where a Server keeps its entries. Any cache backend satisfies it.
+type Store interface {
+	GetEntry(string) (io.ReadCloser, error)
+	PutEntry(string, io.Reader) (int64, error)
+	Has(string) (bool, error)
+}
+
+// evictor is implemented by stores that can enforce a size quota.
+type evictor interface {
+	Evict(maxBytes int64) ([]string, error)
+}
+
+// Server serves a Store over the same protocol HTTPCache speaks. Entries are
+// accepted at {prefix}/ac/{digest} and {prefix}/cas/{digest}, so Bazel can
+// share the server with ccmd.
+type Server struct {
+	Store Store
+
+	// Tokens may read and write, ReadOnlyTokens may only read. Without any
+	// tokens the server is open to everyone.
+	Tokens         []string
+	ReadOnlyTokens []string
+
+	// MaxEntrySize rejects larger uploads, MaxTotalSize evicts the least
+	// recently used entries once the store grows past it. Zero means no limit.
+	MaxEntrySize int64
+	MaxTotalSize int64
+
+	// Log receives one line per request when set.
+	Log func(format string, args ...any)
+
+	evictMu sync.Mutex
+}
+
+var entryPath = regexp.MustCompile(`^/(?:.+/)?(ac|cas)/([a-f0-9]{64})$`)
+
+type access int
+
+const (
+	noAccess access = iota
+	readAccess
+	writeAccess
+)
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.serve(rec, r)
+
+	if s.Log != nil {
+		s.Log("%s %s %d\n", r.Method, r.URL.Path, rec.status)
+	}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	match := entryPath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	// content addressed blobs are kept apart from action cache entries
+	key := match[2]
+	if match[1] == "cas" {
+		key = "cas-" + key
+	}
+
+	granted := s.authorize(r)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if granted < readAccess {
+			s.denyAccess(w, granted)
+			return
+		}
+		if r.Method == http.MethodHead {
+			s.head(w, key)
+			return
+		}
+		s.get(w, key)
+
+	case http.MethodPut:
+		if granted < writeAccess {
+			s.denyAccess(w, granted)
+			return
+		}
+		s.put(w, r, key)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) get(w http.ResponseWriter, key string) {
+	body, err := s.Store.GetEntry(key)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	io.Copy(w, body)
+}
+
+// head answers existence checks without reading the entry, which would count
+// as a use for eviction and download it from remote stores.
+func (s *Server) head(w http.ResponseWriter, key string) {
+	ok, err := s.Store.Has(key)
+	if err != nil {
+		http.Error(w, "could not check entry", http.StatusInternalServerError)
+		if s.Log != nil {
+			s.Log("error checking %s: %s\n", key, err.Error())
+		}
+		return
+	}
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+}
+
+func (s *Server) put(w http.ResponseWriter, r *http.Request, key string) {
+	if s.MaxEntrySize > 0 {
+		if r.ContentLength > s.MaxEntrySize {
+			http.Error(w, fmt.Sprintf("entry exceeds the maximum size of %d bytes", s.MaxEntrySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.MaxEntrySize)
+	}
+
+	if _, err := s.Store.PutEntry(key, r.Body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("entry exceeds the maximum size of %d bytes", s.MaxEntrySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(w, "could not store entry", http.StatusInternalServerError)
+		if s.Log != nil {
+			s.Log("error storing %s: %s\n", key, err.Error())
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	s.evict()
+}
+
+// evict brings the store back under MaxTotalSize, if the store supports it.
+func (s *Server) evict() {
+	store, ok := s.Store.(evictor)
+	if !ok || s.MaxTotalSize <= 0 {
+		return
+	}
+
+	s.evictMu.Lock()
+	defer s.evictMu.Unlock()
+
+	evicted, err := store.Evict(s.MaxTotalSize)
+	if s.Log == nil {
+		return
+	}
+	if err != nil {
+		s.Log("error evicting entries: %s\n", err.Error())
+	}
+	if len(evicted) > 0 {
+		s.Log("evicted %d entries to stay within quota\n", len(evicted))
+	}
+}
+
+// authorize returns the access granted by the request's token, taken from a
+// bearer token or the password of basic auth.
+func (s *Server) authorize(r *http.Request) access {
+	if len(s.Tokens) == 0 && len(s.ReadOnlyTokens) == 0 {
+		return writeAccess
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, _ = r.BasicAuth()
+	}
+
+	if token == "" {
+		return noAccess
+	}
+
+	switch {
+	case containsToken(s.Tokens, token):
+		return writeAccess
+	case containsToken(s.ReadOnlyTokens, token):
+		return readAccess
+	default:
+		return noAccess
+	}
+}
+
+func (s *Server) denyAccess(w http.ResponseWriter, granted access) {
+	if granted == noAccess {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ccmd"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	http.Error(w, "token is read-only", http.StatusForbidden)
+}
+
+func containsToken(tokens []string, token string) bool {
+	found := false
+	for _, t := range tokens {
+		// compare against every token so timing does not reveal a match
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// statusRecorder remembers the status code for the request log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,201 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/simse/ccmd/internal"
+	"github.com/spf13/afero"
+)
+
+func newTestServer(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	if s.Store == nil {
+		s.Store = &internal.LocalCache{URI: "local://cache", FS: afero.NewMemMapFs()}
+	}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestServerRoundTrip(t *testing.T) {
+	server := newTestServer(t, &Server{})
+	c := &HTTPCache{URI: server.URL + "/ccmd", Client: server.Client()}
+
+	if _, err := c.PutEntry("mykey", bytes.NewBufferString("hello")); err != nil {
+		t.Fatalf("PutEntry returned error: %v", err)
+	}
+
+	rc, err := c.GetEntry("mykey")
+	if err != nil {
+		t.Fatalf("GetEntry returned error: %v", err)
+	}
+	defer rc.Close()
+
+	data, _ := io.ReadAll(rc)
+	if string(data) != "hello" {
+		t.Errorf("data = %q; want %q", data, "hello")
+	}
+
+	if ok, err := c.Has("mykey"); err != nil || !ok {
+		t.Errorf("Has(mykey) = %v, %v; want true", ok, err)
+	}
+	if _, err := c.GetEntry("other"); err == nil || err.Error() != `entry "other" not found` {
+		t.Errorf("GetEntry(other) err = %v; want not found", err)
+	}
+}
+
+func TestServerTokens(t *testing.T) {
+	server := newTestServer(t, &Server{
+		Tokens:         []string{"secret"},
+		ReadOnlyTokens: []string{"reader"},
+	})
+
+	cases := []struct {
+		name    string
+		cache   *HTTPCache
+		wantPut string
+		wantGet string
+	}{
+		{"no token", &HTTPCache{URI: server.URL}, "access denied by server: 401 Unauthorized", "access denied by server: 401 Unauthorized"},
+		{"wrong token", &HTTPCache{URI: server.URL, Token: "guess"}, "access denied by server: 401 Unauthorized", "access denied by server: 401 Unauthorized"},
+		{"read-only token", &HTTPCache{URI: server.URL, Token: "reader"}, "access denied by server: 403 Forbidden", ""},
+		{"token", &HTTPCache{URI: server.URL, Token: "secret"}, "", ""},
+		{"basic auth", &HTTPCache{URI: strings.Replace(server.URL, "http://", "http://ci:secret@", 1)}, "", ""},
+	}
+
+	// seed an entry to read
+	seed := &HTTPCache{URI: server.URL, Token: "secret"}
+	if _, err := seed.PutEntry("mykey", bytes.NewBufferString("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.cache.PutEntry("other", bytes.NewBufferString("hello"))
+			if got := errString(err); got != tc.wantPut {
+				t.Errorf("PutEntry err = %q; want %q", got, tc.wantPut)
+			}
+
+			rc, err := tc.cache.GetEntry("mykey")
+			if got := errString(err); got != tc.wantGet {
+				t.Errorf("GetEntry err = %q; want %q", got, tc.wantGet)
+			}
+			if rc != nil {
+				rc.Close()
+			}
+		})
+	}
+}
+
+func TestServerMaxEntrySize(t *testing.T) {
+	server := newTestServer(t, &Server{MaxEntrySize: 4})
+	c := &HTTPCache{URI: server.URL, Client: server.Client()}
+
+	_, err := c.PutEntry("mykey", bytes.NewBufferString("hello"))
+	if err == nil || err.Error() != "unexpected response from server: 413 Request Entity Too Large" {
+		t.Fatalf("err = %v; want 413", err)
+	}
+
+	// chunked uploads are cut off while reading
+	req, _ := http.NewRequest(http.MethodPut, c.EntryURL("mykey"), io.NopCloser(strings.NewReader("hello")))
+	res, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked upload status = %d; want 413", res.StatusCode)
+	}
+
+	if ok, _ := c.Has("mykey"); ok {
+		t.Error("oversized entry was stored")
+	}
+}
+
+func TestServerQuota(t *testing.T) {
+	server := newTestServer(t, &Server{MaxTotalSize: 10})
+	c := &HTTPCache{URI: server.URL, Client: server.Client()}
+
+	for _, key := range []string{"first", "second", "third"} {
+		if _, err := c.PutEntry(key, bytes.NewBufferString("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ok, _ := c.Has("first"); ok {
+		t.Error("least recently used entry should have been evicted")
+	}
+	if ok, _ := c.Has("third"); !ok {
+		t.Error("newest entry should have been kept")
+	}
+}
+
+func TestServerQuotaIgnoresHead(t *testing.T) {
+	server := newTestServer(t, &Server{MaxTotalSize: 10})
+	c := &HTTPCache{URI: server.URL, Client: server.Client()}
+
+	for _, key := range []string{"first", "second"} {
+		if _, err := c.PutEntry(key, bytes.NewBufferString("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an existence check is not a use of the entry
+	if ok, err := c.Has("first"); err != nil || !ok {
+		t.Fatalf("Has(first) = %v, %v; want true", ok, err)
+	}
+
+	if _, err := c.PutEntry("third", bytes.NewBufferString("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := c.Has("first"); ok {
+		t.Error("checking an entry should not keep it from being evicted")
+	}
+	if ok, _ := c.Has("second"); !ok {
+		t.Error("second entry should have been kept")
+	}
+}
+
+func TestServerPaths(t *testing.T) {
+	server := newTestServer(t, &Server{})
+	digest := strings.Repeat("a", 64)
+
+	cases := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodPut, "/cas/" + digest, http.StatusCreated},
+		{http.MethodGet, "/cas/" + digest, http.StatusOK},
+		{http.MethodGet, "/ac/" + digest, http.StatusNotFound},
+		{http.MethodGet, "/ac/abc", http.StatusNotFound},
+		{http.MethodGet, "/", http.StatusNotFound},
+		{http.MethodDelete, "/ac/" + digest, http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest(tc.method, server.URL+tc.path, strings.NewReader("blob"))
+		res, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tc.want {
+			t.Errorf("%s %s = %d; want %d", tc.method, tc.path, res.StatusCode, tc.want)
+		}
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,361 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/simse/ccmd/internal"
+)
+
+const (
+	defaultTTL       = 7 * 24 * time.Hour
+	defaultChunkSize = 1 << 20
+
+	keyPrefix = "ccmd:"
+
+	// how long the chunks of a replaced entry are kept for its readers
+	replacedGrace = 10 * time.Minute
+)
+
+// RedisCache stores entries in Redis or Valkey, named in the URI as
+// redis://[user:password@]host:port/db, or rediss:// for TLS.
+//
+// An entry is stored as a header key naming the generation and number of
+// chunks, and the chunks themselves, so values stay small enough for Redis to
+// handle well. Every write has its own generation and writes the header
+// last, so a reader never sees a partial or mixed entry. Every
+// key expires after the TTL, set with ?ttl=24h (ttl=0 keeps entries until
+// Redis evicts them), and the chunk size is set with ?chunk_size=512KiB.
+type RedisCache struct {
+	URI    string
+	Client goredis.UniversalClient // tests inject, otherwise we build one
+}
+
+// options holds the parameters ccmd reads from the URI, the rest are passed
+// to the Redis client.
+type options struct {
+	ttl       time.Duration
+	chunkSize int64
+	clientURI string
+}
+
+func (r *RedisCache) parseOptions() (*options, error) {
+	u, err := url.Parse(r.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &options{ttl: defaultTTL, chunkSize: defaultChunkSize}
+	query := u.Query()
+
+	if ttl := query.Get("ttl"); ttl != "" {
+		opts.ttl, err = time.ParseDuration(ttl)
+		if err != nil || opts.ttl < 0 {
+			return nil, fmt.Errorf("invalid ttl %q", ttl)
+		}
+	}
+
+	if chunkSize := query.Get("chunk_size"); chunkSize != "" {
+		var size internal.ByteSize
+		if err := size.UnmarshalText([]byte(chunkSize)); err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid chunk_size %q", chunkSize)
+		}
+		opts.chunkSize = int64(size)
+	}
+
+	query.Del("ttl")
+	query.Del("chunk_size")
+	u.RawQuery = query.Encode()
+	opts.clientURI = u.String()
+
+	return opts, nil
+}
+
+func (r *RedisCache) Validate() error {
+	opts, err := r.parseOptions()
+	if err != nil {
+		return err
+	}
+
+	// the client rejects unknown schemes and options
+	_, err = goredis.ParseURL(opts.clientURI)
+	return err
+}
+
+func (r *RedisCache) getClient() (goredis.UniversalClient, error) {
+	if r.Client == nil {
+		opts, err := r.parseOptions()
+		if err != nil {
+			return nil, err
+		}
+
+		clientOpts, err := goredis.ParseURL(opts.clientURI)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Client = goredis.NewClient(clientOpts)
+	}
+
+	return r.Client, nil
+}
+
+func (r *RedisCache) GetFriendlyName() string {
+	return "redis"
+}
+
+func headerKey(key string) string {
+	return keyPrefix + key
+}
+
+func chunkKey(key string, generation string, i int) string {
+	return fmt.Sprintf("%s%s:%s:%d", keyPrefix, key, generation, i)
+}
+
+// header is what the header key of an entry holds, as generation:chunks.
+// Each write stores its chunks under a new generation, so writers storing
+// the same key at once, or replacing an entry being read, never mix chunks.
+type header struct {
+	generation string
+	chunks     int
+}
+
+func parseHeader(value string) (header, bool) {
+	generation, count, ok := strings.Cut(value, ":")
+	chunks, err := strconv.Atoi(count)
+	if !ok || generation == "" || err != nil || chunks < 1 {
+		return header{}, false
+	}
+	return header{generation: generation, chunks: chunks}, true
+}
+
+func (h header) String() string {
+	return fmt.Sprintf("%s:%d", h.generation, h.chunks)
+}
+
+func newGeneration() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// queueExists queues a check for each chunk of h, starting at from.
+func queueExists(ctx context.Context, pipe goredis.Pipeliner, key string, h header, from int) []*goredis.IntCmd {
+	cmds := make([]*goredis.IntCmd, 0, h.chunks-from)
+	for i := from; i < h.chunks; i++ {
+		cmds = append(cmds, pipe.Exists(ctx, chunkKey(key, h.generation, i)))
+	}
+	return cmds
+}
+
+func anyMissing(cmds []*goredis.IntCmd) bool {
+	for _, cmd := range cmds {
+		if cmd.Val() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// getHeader returns the header of key, or false if there is no entry.
+func (r *RedisCache) getHeader(ctx context.Context, client goredis.UniversalClient, key string) (header, bool, error) {
+	value, err := client.Get(ctx, headerKey(key)).Result()
+	if errors.Is(err, goredis.Nil) {
+		return header{}, false, nil
+	}
+	if err != nil {
+		return header{}, false, err
+	}
+
+	h, ok := parseHeader(value)
+	if !ok {
+		return header{}, false, fmt.Errorf("entry %q has a corrupt header", key)
+	}
+	return h, true, nil
+}
+
+func (r *RedisCache) GetEntry(key string) (io.ReadCloser, error) {
+	client, err := r.getClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.TODO()
+
+	h, found, err := r.getHeader(ctx, client, key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("entry %q not found", key)
+	}
+
+	// chunks can be evicted one by one under memory pressure, so check
+	// they are all there before committing to this entry. Most entries are
+	// a single chunk, which is fetched along the way.
+	var first *goredis.StringCmd
+	var exists []*goredis.IntCmd
+	if _, err := client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		first = pipe.Get(ctx, chunkKey(key, h.generation, 0))
+		exists = queueExists(ctx, pipe, key, h, 1)
+		return nil
+	}); err != nil && !errors.Is(err, goredis.Nil) {
+		return nil, err
+	}
+
+	if first.Err() != nil || anyMissing(exists) {
+		return nil, fmt.Errorf("entry %q is incomplete, chunks were evicted", key)
+	}
+
+	return &chunkReader{
+		ctx:    ctx,
+		client: client,
+		key:    key,
+		header: h,
+		next:   1,
+		buf:    []byte(first.Val()),
+	}, nil
+}
+
+// Has checks for a complete entry without fetching it.
+func (r *RedisCache) Has(key string) (bool, error) {
+	client, err := r.getClient()
+	if err != nil {
+		return false, err
+	}
+	ctx := context.TODO()
+
+	h, found, err := r.getHeader(ctx, client, key)
+	if err != nil || !found {
+		return false, err
+	}
+
+	var exists []*goredis.IntCmd
+	if _, err := client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		exists = queueExists(ctx, pipe, key, h, 0)
+		return nil
+	}); err != nil {
+		return false, err
+	}
+
+	return !anyMissing(exists), nil
+}
+
+func (r *RedisCache) PutEntry(key string, body io.Reader) (int64, error) {
+	client, err := r.getClient()
+	if err != nil {
+		return 0, err
+	}
+
+	opts, err := r.parseOptions()
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.TODO()
+
+	h := header{generation: newGeneration()}
+	total, err := r.putChunks(ctx, client, key, &h, body, opts)
+	if err != nil {
+		// chunks of a write that never got a header are unreachable
+		r.deleteChunks(ctx, client, key, h)
+		return 0, err
+	}
+
+	previous, err := client.SetArgs(ctx, headerKey(key), h.String(), goredis.SetArgs{TTL: opts.ttl, Get: true}).Result()
+	if err != nil && !errors.Is(err, goredis.Nil) {
+		return 0, err
+	}
+
+	// readers of the replaced entry get some time to finish
+	if old, ok := parseHeader(previous); ok && old.generation != h.generation {
+		client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+			for i := 0; i < old.chunks; i++ {
+				pipe.Expire(ctx, chunkKey(key, old.generation, i), replacedGrace)
+			}
+			return nil
+		})
+	}
+
+	return total, nil
+}
+
+// putChunks writes body as chunks of h's generation, counting them in h.
+func (r *RedisCache) putChunks(ctx context.Context, client goredis.UniversalClient, key string, h *header, body io.Reader, opts *options) (int64, error) {
+	var total int64
+	buf := make([]byte, opts.chunkSize)
+
+	for {
+		n, err := io.ReadFull(body, buf)
+		if n > 0 || h.chunks == 0 {
+			if err := client.Set(ctx, chunkKey(key, h.generation, h.chunks), buf[:n], opts.ttl).Err(); err != nil {
+				return 0, err
+			}
+			h.chunks++
+			total += int64(n)
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return total, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *RedisCache) deleteChunks(ctx context.Context, client goredis.UniversalClient, key string, h header) {
+	if h.chunks == 0 {
+		return
+	}
+
+	keys := make([]string, h.chunks)
+	for i := range keys {
+		keys[i] = chunkKey(key, h.generation, i)
+	}
+	client.Del(ctx, keys...)
+}
+
+// chunkReader streams the chunks of an entry, fetching one at a time.
+type chunkReader struct {
+	ctx    context.Context
+	client goredis.UniversalClient
+	key    string
+	header header
+	next   int
+	buf    []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.next >= c.header.chunks {
+			return 0, io.EOF
+		}
+
+		data, err := c.client.Get(c.ctx, chunkKey(c.key, c.header.generation, c.next)).Bytes()
+		if errors.Is(err, goredis.Nil) {
+			return 0, fmt.Errorf("chunk %d of entry %q was evicted while reading", c.next, c.key)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		c.buf = data
+		c.next++
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkReader) Close() error {
+	return nil
+}
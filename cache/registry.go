@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Config is a backend URI, split into its parts for a Factory.
+type Config struct {
+	// URI is the whole URI as given, e.g. s3://bucket/prefix?region=eu-west-1
+	URI string
+
+	Scheme   string
+	User     *url.Userinfo
+	Host     string
+	Path     string
+	Query    url.Values
+	Fragment string
+}
+
+// Factory creates the provider for a backend URI. Providers are created to
+// validate arguments too, so a factory should not connect to anything, that
+// is left to the first GetEntry or PutEntry.
+type Factory func(config Config) (CacheProvider, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a backend available under scheme, so that URIs starting with
+// scheme:// are handled by factory. It is meant to be called from init, and
+// panics if the scheme is already registered.
+func Register(scheme string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	scheme = strings.ToLower(scheme)
+	if factory == nil {
+		panic("cache: Register factory is nil for scheme " + scheme)
+	}
+	if _, exists := registry[scheme]; exists {
+		panic("cache: Register called twice for scheme " + scheme)
+	}
+
+	registry[scheme] = factory
+}
+
+// Schemes lists the registered schemes, in alphabetical order.
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	schemes := make([]string, 0, len(registry))
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// ParseURI splits a backend URI into a Config. Some URIs, such as local://
+// with a Windows path, are not valid URLs, in which case only URI and Scheme
+// are set, Query is nil, and the factory parses the rest itself.
+func ParseURI(uri string) (Config, error) {
+	scheme, _, ok := strings.Cut(uri, "://")
+	if !ok || scheme == "" {
+		return Config{}, errors.New("URI must start with a scheme, e.g. s3://")
+	}
+
+	config := Config{URI: uri, Scheme: strings.ToLower(scheme)}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return config, nil
+	}
+
+	config.User = u.User
+	config.Host = u.Host
+	config.Path = u.Path
+	config.Query = u.Query()
+	config.Fragment = u.Fragment
+
+	return config, nil
+}
+
+func GetCacheProviderFromURI(uri string) (CacheProvider, error) {
+	config, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	registryMu.RLock()
+	factory, ok := registry[config.Scheme]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported cache provider %q, expected one of %s", config.Scheme, strings.Join(Schemes(), ", "))
+	}
+
+	return factory(config)
+}
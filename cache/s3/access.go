@@ -0,0 +1,150 @@
+package s3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/simse/ccmd/internal"
+)
+
+// what CheckAccess needs from S3
+type AccessAPI interface {
+	HeadBucket(ctx context.Context, in *s3.HeadBucketInput, opts ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	GetObject(ctx context.Context, in *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, in *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(ctx context.Context, in *s3.DeleteObjectInput, opts ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// the object written and read back to probe permissions, next to the entries.
+// Each check adds a random suffix, so parallel jobs do not delete each
+// other's probe.
+const accessProbePrefix = ".ccmd-access-probe-"
+
+// CheckAccess finds out whether the credentials can read and write entries,
+// by checking the bucket exists and writing, reading and deleting a probe
+// object. An error means the bucket cannot be used at all. Reading can only
+// be proven denied when writing is allowed.
+func (s *S3Cache) CheckAccess() (read internal.Access, write internal.Access, err error) {
+	client := s.AccessClient
+	if client == nil {
+		client, err = s.newClient()
+		if err != nil {
+			return internal.AccessDenied, internal.AccessDenied, err
+		}
+	}
+
+	opts, err := s.GetOptions()
+	if err != nil {
+		return internal.AccessDenied, internal.AccessDenied, err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return internal.AccessDenied, internal.AccessDenied, err
+	}
+	probeName := accessProbePrefix + hex.EncodeToString(suffix)
+
+	ctx := context.TODO()
+	bucket := aws.String(s.GetBucketName())
+	probeKey := aws.String(s.getObjectKey(probeName))
+
+	// HeadBucket needs s3:ListBucket, which a cache can do without, so only
+	// a missing bucket is fatal
+	if _, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: bucket}); err != nil && !isAccessDenied(err) {
+		if isNotFound(err) {
+			return internal.AccessDenied, internal.AccessDenied, fmt.Errorf("bucket %q does not exist", s.GetBucketName())
+		}
+		return internal.AccessDenied, internal.AccessDenied, s.apiError(err, "")
+	}
+
+	// written with the same settings as entries, since bucket policies
+	// often require encryption, tags or a storage class
+	put := &s3.PutObjectInput{
+		Bucket:               bucket,
+		Key:                  probeKey,
+		Body:                 strings.NewReader("ccmd"),
+		StorageClass:         opts.StorageClass,
+		ServerSideEncryption: opts.SSE,
+	}
+	if opts.SSEKMSKeyID != "" {
+		put.SSEKMSKeyId = aws.String(opts.SSEKMSKeyID)
+	}
+	if len(opts.Tags) > 0 {
+		put.Tagging = aws.String(opts.Tags.Encode())
+	}
+
+	_, err = client.PutObject(ctx, put)
+	switch {
+	case err == nil:
+		write = internal.AccessAllowed
+		defer client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: bucket, Key: probeKey})
+	case isAccessDenied(err):
+		write = internal.AccessDenied
+	default:
+		return internal.AccessDenied, internal.AccessDenied, s.apiError(err, probeName)
+	}
+
+	// after a failed write, the probe is missing, which still proves the
+	// credentials may read. Without s3:ListBucket, S3 answers AccessDenied
+	// for a missing key instead, so then nothing is known about reading. A
+	// probe that was written but is not found, e.g. because a lifecycle rule
+	// or replication got in the way, does not tell either.
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: probeKey})
+	switch {
+	case err == nil:
+		output.Body.Close()
+		read = internal.AccessAllowed
+	case isNotFound(err) && write == internal.AccessDenied:
+		read = internal.AccessAllowed
+	case isNotFound(err):
+		read = internal.AccessUnknown
+	case isAccessDenied(err) && write == internal.AccessDenied:
+		read = internal.AccessUnknown
+	case isAccessDenied(err):
+		read = internal.AccessDenied
+	default:
+		return internal.AccessDenied, internal.AccessDenied, s.apiError(err, probeName)
+	}
+
+	return read, write, nil
+}
+
+func isAccessDenied(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "AccessDenied", "Forbidden", "AllAccessDisabled":
+			return true
+		}
+	}
+
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusForbidden
+}
+
+// isNotFound reports whether the object, or for HeadBucket the bucket, is
+// missing. Responses to HEAD requests have no body, so all they carry is the
+// status code.
+func isNotFound(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return true
+		case "NoSuchBucket":
+			return false
+		}
+	}
+
+	var respErr *smithyhttp.ResponseError
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotFound
+}
@@ -6,19 +6,25 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
+	"github.com/simse/ccmd/internal"
 )
 
 // only what we need for GetEntry
 type S3API interface {
 	GetObject(ctx context.Context, in *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, in *s3.HeadObjectInput, opts ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
 }
 
 // abstracts manager.NewUploader’s Upload method
@@ -27,12 +33,133 @@ type Uploader interface {
 }
 
 type S3Cache struct {
-	URI      string
-	Client   S3API    // for GetEntry
-	Uploader Uploader // for PutEntry; tests inject, otherwise we build one
+	URI string
+
+	Bucket string
+	Prefix string     // path after the bucket, slashes are trimmed
+	Query  url.Values // parsed into Options by GetOptions
+
+	Client       S3API     // for GetEntry and Has
+	Uploader     Uploader  // for PutEntry; tests inject, otherwise we build one
+	AccessClient AccessAPI // for CheckAccess; likewise
+}
+
+// Options are given as query parameters, e.g.
+// s3://bucket?endpoint=http://localhost:9000&region=eu-west-1&path_style=true&profile=ci
+type Options struct {
+	Endpoint  string // for S3-compatible services like MinIO, Ceph or R2
+	Region    string
+	PathStyle bool // address the bucket in the path instead of the host name
+	Profile   string
+
+	// applied to uploaded entries
+	StorageClass types.StorageClass
+	SSE          types.ServerSideEncryption
+	SSEKMSKeyID  string
+	Tags         url.Values // given as tags=team=a,env=ci
+
+	// entries are uploaded and downloaded in parts of PartSize bytes,
+	// Concurrency at a time
+	PartSize    int64
+	Concurrency int
+}
+
+func (s *S3Cache) GetOptions() (Options, error) {
+	opts := Options{PartSize: defaultPartSize, Concurrency: defaultConcurrency}
+
+	var err error
+	query := s.Query
+	for param := range query {
+		switch param {
+		case "endpoint", "region", "path_style", "profile",
+			"storage_class", "sse", "sse_kms_key_id", "tags",
+			"part_size", "concurrency":
+		default:
+			return opts, fmt.Errorf("unknown parameter %q", param)
+		}
+	}
+
+	opts.Endpoint = query.Get("endpoint")
+	opts.Region = query.Get("region")
+	opts.Profile = query.Get("profile")
+
+	if opts.Endpoint != "" {
+		u, err := url.Parse(opts.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return opts, fmt.Errorf("endpoint must be an http or https URL; got %q", opts.Endpoint)
+		}
+	}
+
+	if pathStyle := query.Get("path_style"); pathStyle != "" {
+		opts.PathStyle, err = strconv.ParseBool(pathStyle)
+		if err != nil {
+			return opts, fmt.Errorf("path_style must be true or false; got %q", pathStyle)
+		}
+	}
+
+	if storageClass := types.StorageClass(query.Get("storage_class")); storageClass != "" {
+		switch {
+		case !slices.Contains(storageClass.Values(), storageClass):
+			return opts, fmt.Errorf("unknown storage_class %q", storageClass)
+		case storageClass == types.StorageClassGlacier || storageClass == types.StorageClassDeepArchive:
+			// archived objects must be restored before they can be read
+			return opts, fmt.Errorf("storage_class %q cannot be read back without a restore, use GLACIER_IR instead", storageClass)
+		}
+		opts.StorageClass = storageClass
+	}
+
+	opts.SSE = types.ServerSideEncryption(query.Get("sse"))
+	opts.SSEKMSKeyID = query.Get("sse_kms_key_id")
+
+	if opts.SSEKMSKeyID != "" && opts.SSE == "" {
+		opts.SSE = types.ServerSideEncryptionAwsKms
+	}
+	if opts.SSE != "" && !slices.Contains(opts.SSE.Values(), opts.SSE) {
+		return opts, fmt.Errorf("unknown sse %q, expected AES256, aws:kms or aws:kms:dsse", opts.SSE)
+	}
+	if opts.SSEKMSKeyID != "" && opts.SSE == types.ServerSideEncryptionAes256 {
+		return opts, errors.New("sse_kms_key_id requires sse=aws:kms or sse=aws:kms:dsse")
+	}
+
+	if tags := query.Get("tags"); tags != "" {
+		opts.Tags = url.Values{}
+		for _, tag := range strings.Split(tags, ",") {
+			name, value, _ := strings.Cut(tag, "=")
+			if name == "" {
+				return opts, fmt.Errorf("invalid tag %q, expected name=value", tag)
+			}
+			opts.Tags.Set(name, value)
+		}
+
+		if len(opts.Tags) > 10 {
+			return opts, fmt.Errorf("at most 10 tags can be set; got %d", len(opts.Tags))
+		}
+	}
+
+	if partSize := query.Get("part_size"); partSize != "" {
+		var size internal.ByteSize
+		// multipart uploads need parts of at least 5MiB
+		if err := size.UnmarshalText([]byte(partSize)); err != nil || int64(size) < manager.MinUploadPartSize {
+			return opts, fmt.Errorf("part_size must be at least 5MiB; got %q", partSize)
+		}
+		opts.PartSize = int64(size)
+	}
+
+	if concurrency := query.Get("concurrency"); concurrency != "" {
+		opts.Concurrency, err = strconv.Atoi(concurrency)
+		if err != nil || opts.Concurrency < 1 {
+			return opts, fmt.Errorf("concurrency must be a positive number; got %q", concurrency)
+		}
+	}
+
+	return opts, nil
 }
 
 func (s *S3Cache) Validate() error {
+	if _, err := s.GetOptions(); err != nil {
+		return err
+	}
+
 	name := s.GetBucketName()
 
 	// 1. Length 3–255
@@ -77,21 +204,88 @@ func (s *S3Cache) Validate() error {
 		}
 	}
 
+	// 8. Key prefix must leave room for keys, and not contain empty or
+	// relative segments
+	prefix := s.GetKeyPrefix()
+	if len(prefix) > 512 {
+		return fmt.Errorf("key prefix must be at most 512 characters; got %d", len(prefix))
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(prefix, "/"), "/") {
+		if prefix != "" && (segment == "" || segment == "." || segment == "..") {
+			return fmt.Errorf("key prefix %q must not contain empty, . or .. segments", prefix)
+		}
+	}
+
 	return nil
 }
 
 func (s *S3Cache) GetBucketName() string {
-	return strings.Replace(s.URI, "s3://", "", 1)
+	return s.Bucket
+}
+
+// GetKeyPrefix is the path after the bucket name, e.g. "ccmd/team-a/" for
+// s3://bucket/ccmd/team-a, under which all entries are stored.
+func (s *S3Cache) GetKeyPrefix() string {
+	prefix := strings.Trim(s.Prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+func (s *S3Cache) getObjectKey(key string) string {
+	return s.GetKeyPrefix() + key
+}
+
+// newClient builds a client from the default AWS configuration and the
+// options in the URI.
+func (s *S3Cache) newClient() (*s3.Client, error) {
+	opts, err := s.GetOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	var loadOpts []func(*config.LoadOptions) error
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(opts.Region))
+	}
+	if opts.Profile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigProfile(opts.Profile))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), loadOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// requests must be signed for some region, which self-hosted services
+	// rarely care about
+	if cfg.Region == "" && opts.Endpoint != "" {
+		cfg.Region = "us-east-1"
+	}
+
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = opts.PathStyle
+
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+
+			// not every S3-compatible service understands the checksums AWS
+			// sends by default
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		}
+	}), nil
 }
 
 func (s *S3Cache) getClient() (S3API, error) {
 	if s.Client == nil {
-		cfg, err := config.LoadDefaultConfig(context.TODO())
+		client, err := s.newClient()
 		if err != nil {
 			return nil, err
 		}
 
-		s.Client = s3.NewFromConfig(cfg)
+		s.Client = client
 	}
 
 	return s.Client, nil
@@ -101,6 +295,8 @@ func (s *S3Cache) GetFriendlyName() string {
 	return "s3"
 }
 
+// GetEntry streams the entry, downloading large entries in several parts at
+// once.
 func (s *S3Cache) GetEntry(key string) (io.ReadCloser, error) {
 	client, err := s.getClient()
 
@@ -108,61 +304,154 @@ func (s *S3Cache) GetEntry(key string) (io.ReadCloser, error) {
 		return nil, err
 	}
 
-	// check if entry exists by getting it
-	output, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+	opts, err := s.GetOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	input := s3.GetObjectInput{
 		Bucket: aws.String(s.GetBucketName()),
-		Key:    aws.String(key),
-	})
+		Key:    aws.String(s.getObjectKey(key)),
+	}
+
+	// check if entry exists by getting its first part, which also tells us
+	// its size
+	firstPart := input
+	firstPart.Range = aws.String(byteRange(0, opts.PartSize))
+	output, err := client.GetObject(context.TODO(), &firstPart)
 
 	if err != nil {
 		var apiErr smithy.APIError
-		if errors.As(err, &apiErr) {
-			switch apiErr.ErrorCode() {
-			case "NoSuchBucket":
-				return nil, fmt.Errorf("bucket %q does not exist", s.GetBucketName())
-			case "NoSuchKey":
-				return nil, fmt.Errorf("object %q not found in bucket %q", key, s.GetBucketName())
-			default:
-				return nil, fmt.Errorf("S3 API error %s: %s", apiErr.ErrorCode(), apiErr.ErrorMessage())
-			}
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange" {
+			// empty objects have no first part
+			output, err = client.GetObject(context.TODO(), &input)
 		}
+	}
 
-		return nil, err
+	if err != nil {
+		return nil, s.apiError(err, key)
 	}
 
-	return output.Body, nil
+	size, ranged := objectSize(output.ContentRange)
+	if !ranged || size <= opts.PartSize {
+		return output.Body, nil
+	}
+
+	// the rest must come from the same version of the entry
+	input.IfMatch = output.ETag
+
+	return newRangedReader(client, input, output.Body, size, opts.PartSize, opts.Concurrency), nil
 }
 
-type CountingReader struct {
-	Reader    io.Reader
-	ByteCount int64
+func (s *S3Cache) apiError(err error, key string) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchBucket":
+			return fmt.Errorf("bucket %q does not exist", s.GetBucketName())
+		case "NoSuchKey":
+			return fmt.Errorf("object %q not found in bucket %q", s.getObjectKey(key), s.GetBucketName())
+		default:
+			return fmt.Errorf("S3 API error %s: %s", apiErr.ErrorCode(), apiErr.ErrorMessage())
+		}
+	}
+
+	return err
 }
 
-func (c *CountingReader) Read(p []byte) (int, error) {
-	nn, err := c.Reader.Read(p)
-	c.ByteCount += int64(nn)
-	return nn, err
+// Has checks for an entry with a HEAD request.
+func (s *S3Cache) Has(key string) (bool, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.GetBucketName()),
+		Key:    aws.String(s.getObjectKey(key)),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, s.apiError(err, key)
+	}
+
+	return true, nil
 }
 
+type CountingReader = internal.CountingReader
+
 func (s *S3Cache) PutEntry(key string, body io.Reader) (int64, error) {
+	return s.PutEntryWithMetadata(key, body, nil)
+}
+
+// maximum length of a metadata value, S3 allows 2KB of metadata in total
+const maxMetadataValue = 512
+
+// PutEntryWithMetadata stores metadata as x-amz-meta-* headers on the object.
+func (s *S3Cache) PutEntryWithMetadata(key string, body io.Reader, metadata map[string]string) (int64, error) {
+	opts, err := s.GetOptions()
+	if err != nil {
+		return 0, err
+	}
+
 	up := s.Uploader
 	if up == nil {
-		cfg, err := config.LoadDefaultConfig(context.TODO())
+		realClient, err := s.newClient()
 		if err != nil {
 			return 0, err
 		}
-		realClient := s3.NewFromConfig(cfg)
-		up = manager.NewUploader(realClient)
+		up = manager.NewUploader(realClient, func(u *manager.Uploader) {
+			u.PartSize = opts.PartSize
+			u.Concurrency = opts.Concurrency
+		})
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(s.GetBucketName()),
+		Key:                  aws.String(s.getObjectKey(key)),
+		StorageClass:         opts.StorageClass,
+		ServerSideEncryption: opts.SSE,
+	}
+
+	if opts.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(opts.SSEKMSKeyID)
+	}
+	if len(opts.Tags) > 0 {
+		input.Tagging = aws.String(opts.Tags.Encode())
+	}
+
+	if len(metadata) > 0 {
+		input.Metadata = make(map[string]string, len(metadata))
+		for name, value := range metadata {
+			input.Metadata[name] = metadataValue(value)
+		}
 	}
 
 	counter := &CountingReader{Reader: body}
-	if _, err := up.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(s.GetBucketName()),
-		Key:    aws.String(key),
-		Body:   counter,
-	}); err != nil {
+	input.Body = counter
+
+	if _, err := up.Upload(context.TODO(), input); err != nil {
 		return 0, err
 	}
 
 	return counter.ByteCount, nil
 }
+
+// metadataValue makes value safe to send as a header: values with anything
+// but printable ASCII are URL-encoded, and long values are cut short.
+func metadataValue(value string) string {
+	for _, r := range value {
+		if r < 0x20 || r > 0x7e {
+			value = url.QueryEscape(value)
+			break
+		}
+	}
+
+	if len(value) > maxMetadataValue {
+		value = value[:maxMetadataValue-3] + "..."
+	}
+
+	return value
+}
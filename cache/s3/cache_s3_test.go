@@ -3,16 +3,28 @@ package s3
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
+	"github.com/simse/ccmd/internal"
 )
 
 // mock S3 API
@@ -31,6 +43,13 @@ func (f *fakeS3) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*
 	return f.out, f.err
 }
 
+func (f *fakeS3) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if aws.ToString(in.Key) != "mykey" {
+		return nil, fmt.Errorf("key=%q?", aws.ToString(in.Key))
+	}
+	return &s3.HeadObjectOutput{}, f.err
+}
+
 // fakeUploader implements our Uploader interface:
 type fakeUploader struct {
 	in  *s3.PutObjectInput
@@ -46,9 +65,18 @@ func (f *fakeUploader) Upload(_ context.Context, in *s3.PutObjectInput, _ ...fun
 	return &manager.UploadOutput{}, f.err
 }
 
+// fromURI fills in the parts of uri, as the registry does
+func fromURI(uri string) *S3Cache {
+	u, err := url.Parse(uri)
+	if err != nil {
+		panic(err)
+	}
+	return &S3Cache{URI: uri, Bucket: u.Host, Prefix: u.Path, Query: u.Query()}
+}
+
 // actual test cases
 func TestGetBucketName(t *testing.T) {
-	if b := (&S3Cache{URI: "s3://abc"}).GetBucketName(); b != "abc" {
+	if b := fromURI("s3://abc").GetBucketName(); b != "abc" {
 		t.Fatal("got", b)
 	}
 }
@@ -115,7 +143,7 @@ func TestValidateBucketName(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			t.Parallel()
 
-			provider := S3Cache{URI: fmt.Sprintf("s3://%s", tc.name)}
+			provider := S3Cache{Bucket: tc.name}
 
 			err := provider.Validate()
 			if (err != nil) != tc.wantErr {
@@ -138,7 +166,7 @@ func FuzzValidate(f *testing.F) {
 
 	f.Fuzz(func(t *testing.T, name string) {
 		// Just make sure we never panic or hang
-		provider := S3Cache{URI: fmt.Sprintf("s3://%s", name)}
+		provider := S3Cache{Bucket: name}
 		_ = provider.Validate()
 	})
 }
@@ -162,7 +190,8 @@ func TestGetEntry(t *testing.T) {
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			f := &fakeS3{out: tc.apiOut, err: tc.apiErr}
-			c := &S3Cache{URI: "s3://mybucket", Client: f}
+			c := fromURI("s3://mybucket")
+			c.Client = f
 
 			rc, err := c.GetEntry("mykey")
 			if tc.wantErr != "" {
@@ -181,7 +210,8 @@ func TestGetEntry(t *testing.T) {
 
 	// check that nothing breaks when S3 returns an empty body
 	f := &fakeS3{out: &s3.GetObjectOutput{Body: nil}, err: nil}
-	c := &S3Cache{URI: "s3://test", Client: f}
+	c := fromURI("s3://test")
+	c.Client = f
 
 	_, err := c.GetEntry("foobar")
 	if err == nil {
@@ -192,10 +222,8 @@ func TestGetEntry(t *testing.T) {
 func TestPutEntry_WithManager(t *testing.T) {
 	// inject the fakeUploader so we never hit real AWS
 	fu := &fakeUploader{}
-	c := &S3Cache{
-		URI:      "s3://mybucket",
-		Uploader: fu,
-	}
+	c := fromURI("s3://mybucket")
+	c.Uploader = fu
 
 	// successful upload
 	n, err := c.PutEntry("mykey", bytes.NewBufferString("hello"))
@@ -297,3 +325,590 @@ func FuzzCountingReader(f *testing.F) {
 		}
 	})
 }
+
+func TestGetOptions(t *testing.T) {
+	tests := []struct {
+		uri     string
+		want    Options
+		wantErr bool
+	}{
+		{"s3://mybucket", Options{}, false},
+		{"s3://mybucket?endpoint=http://localhost:9000&region=eu-west-1&path_style=true&profile=ci", Options{
+			Endpoint:  "http://localhost:9000",
+			Region:    "eu-west-1",
+			PathStyle: true,
+			Profile:   "ci",
+		}, false},
+
+		{"s3://mybucket?storage_class=STANDARD_IA&sse_kms_key_id=alias/ccmd&tags=team=a,env=ci", Options{
+			StorageClass: types.StorageClassStandardIa,
+			SSE:          types.ServerSideEncryptionAwsKms,
+			SSEKMSKeyID:  "alias/ccmd",
+			Tags:         url.Values{"team": {"a"}, "env": {"ci"}},
+		}, false},
+		{"s3://mybucket?sse=AES256", Options{SSE: types.ServerSideEncryptionAes256}, false},
+		{"s3://mybucket?part_size=64MiB&concurrency=16", Options{PartSize: 64 << 20, Concurrency: 16}, false},
+
+		{"s3://mybucket?path_style=maybe", Options{}, true},
+		{"s3://mybucket?storage_class=CHEAP", Options{}, true},
+		{"s3://mybucket?storage_class=GLACIER", Options{}, true},
+		{"s3://mybucket?sse=rot13", Options{}, true},
+		{"s3://mybucket?sse=AES256&sse_kms_key_id=alias/ccmd", Options{}, true},
+		{"s3://mybucket?tags==a", Options{}, true},
+		{"s3://mybucket?part_size=1MB", Options{}, true},
+		{"s3://mybucket?concurrency=0", Options{}, true},
+		{"s3://mybucket?endpoint=localhost:9000", Options{}, true},
+		{"s3://mybucket?colour=blue", Options{}, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.uri, func(t *testing.T) {
+			c := fromURI(tc.uri)
+
+			// unless the case sets them
+			if tc.want.PartSize == 0 {
+				tc.want.PartSize = defaultPartSize
+			}
+			if tc.want.Concurrency == 0 {
+				tc.want.Concurrency = defaultConcurrency
+			}
+
+			got, err := c.GetOptions()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("GetOptions(%q) err=%v, wantErr=%v", tc.uri, err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) && !tc.wantErr {
+				t.Errorf("GetOptions(%q) = %+v; want %+v", tc.uri, got, tc.want)
+			}
+			if (c.Validate() != nil) != tc.wantErr {
+				t.Errorf("Validate(%q) disagrees with GetOptions", tc.uri)
+			}
+			if c.GetBucketName() != "mybucket" {
+				t.Errorf("GetBucketName(%q) = %q", tc.uri, c.GetBucketName())
+			}
+		})
+	}
+}
+
+// isolate from any AWS configuration on the machine running the tests
+func setTestCredentials(t *testing.T) {
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_PROFILE", "")
+}
+
+func TestCustomEndpoint(t *testing.T) {
+	setTestCredentials(t)
+
+	var gotPath, gotAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	c := fromURI("s3://mybucket?endpoint=" + server.URL + "&region=eu-west-1&path_style=true")
+
+	rc, err := c.GetEntry("mykey")
+	if err != nil {
+		t.Fatalf("GetEntry returned error: %v", err)
+	}
+	defer rc.Close()
+
+	data, _ := io.ReadAll(rc)
+	if string(data) != "hello" {
+		t.Errorf("data = %q; want %q", data, "hello")
+	}
+	if gotPath != "/mybucket/mykey" {
+		t.Errorf("path = %q; want the bucket in the path", gotPath)
+	}
+	if !strings.Contains(gotAuth, "/eu-west-1/s3/") {
+		t.Errorf("request was not signed for eu-west-1: %q", gotAuth)
+	}
+}
+
+// TestMinIO runs against a real S3-compatible server when one is available,
+// e.g. docker run -p 9000:9000 minio/minio server /data, with
+// CCMD_TEST_S3_ENDPOINT=http://localhost:9000 and credentials in
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func TestMinIO(t *testing.T) {
+	endpoint := os.Getenv("CCMD_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("set CCMD_TEST_S3_ENDPOINT to run against MinIO")
+	}
+
+	c := fromURI("s3://ccmd-test?path_style=true&endpoint=" + url.QueryEscape(endpoint))
+
+	client, err := c.newClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.CreateBucket(context.TODO(), &s3.CreateBucketInput{Bucket: aws.String("ccmd-test")})
+	var owned *types.BucketAlreadyOwnedByYou
+	if err != nil && !errors.As(err, &owned) {
+		t.Fatalf("CreateBucket: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("ccmd"), 1<<20)
+	if _, err := c.PutEntry("minio-test", bytes.NewReader(data)); err != nil {
+		t.Fatalf("PutEntry returned error: %v", err)
+	}
+
+	rc, err := c.GetEntry("minio-test")
+	if err != nil {
+		t.Fatalf("GetEntry returned error: %v", err)
+	}
+	defer rc.Close()
+
+	got, _ := io.ReadAll(rc)
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded %d bytes that do not match the %d uploaded", len(got), len(data))
+	}
+
+	_, err = c.GetEntry("minio-missing")
+	if err == nil || err.Error() != `object "minio-missing" not found in bucket "ccmd-test"` {
+		t.Errorf("err = %v; want not found", err)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	tests := []struct {
+		uri        string
+		wantBucket string
+		wantPrefix string
+		wantErr    bool
+	}{
+		{"s3://shared-bucket", "shared-bucket", "", false},
+		{"s3://shared-bucket/", "shared-bucket", "", false},
+		{"s3://shared-bucket/ccmd/team-a", "shared-bucket", "ccmd/team-a/", false},
+		{"s3://shared-bucket/ccmd/team-a/?region=eu-west-1", "shared-bucket", "ccmd/team-a/", false},
+
+		{"s3://shared-bucket/ccmd//team-a", "shared-bucket", "ccmd//team-a/", true},
+		{"s3://shared-bucket/ccmd/../team-b", "shared-bucket", "ccmd/../team-b/", true},
+		{"s3://shared-bucket/" + strings.Repeat("a", 600), "shared-bucket", strings.Repeat("a", 600) + "/", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.uri, func(t *testing.T) {
+			c := fromURI(tc.uri)
+			if got := c.GetBucketName(); got != tc.wantBucket {
+				t.Errorf("GetBucketName = %q; want %q", got, tc.wantBucket)
+			}
+			if got := c.GetKeyPrefix(); got != tc.wantPrefix {
+				t.Errorf("GetKeyPrefix = %q; want %q", got, tc.wantPrefix)
+			}
+			if err := c.Validate(); (err != nil) != tc.wantErr {
+				t.Errorf("Validate err=%v, wantErr=%v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyPrefixIsUsed(t *testing.T) {
+	setTestCredentials(t)
+
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+	}))
+	defer server.Close()
+
+	c := fromURI("s3://mybucket/ccmd/team-a?path_style=true&endpoint=" + server.URL)
+
+	_, err := c.GetEntry("mykey")
+	if err == nil || err.Error() != `object "ccmd/team-a/mykey" not found in bucket "mybucket"` {
+		t.Errorf("err = %v; want not found with the full key", err)
+	}
+	if gotPath != "/mybucket/ccmd/team-a/mykey" {
+		t.Errorf("path = %q; want the key under the prefix", gotPath)
+	}
+
+	fu := &fakeUploader{}
+	c.Uploader = fu
+	if _, err := c.PutEntry("mykey", bytes.NewBufferString("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToString(fu.in.Key) != "ccmd/team-a/mykey" {
+		t.Errorf("uploaded key = %q; want it under the prefix", aws.ToString(fu.in.Key))
+	}
+}
+
+func TestPutEntryWithMetadata(t *testing.T) {
+	fu := &fakeUploader{}
+	c := fromURI("s3://mybucket?storage_class=INTELLIGENT_TIERING&sse=aws:kms&sse_kms_key_id=alias/ccmd&tags=team=a")
+	c.Uploader = fu
+
+	_, err := c.PutEntryWithMetadata("mykey", bytes.NewBufferString("hello"), map[string]string{
+		"ccmd-version": "1.2.3",
+		"command":      "echo héllo\nworld",
+		"long":         strings.Repeat("x", 1000),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fu.in.StorageClass != types.StorageClassIntelligentTiering {
+		t.Errorf("StorageClass = %q", fu.in.StorageClass)
+	}
+	if fu.in.ServerSideEncryption != types.ServerSideEncryptionAwsKms || aws.ToString(fu.in.SSEKMSKeyId) != "alias/ccmd" {
+		t.Errorf("SSE = %q, key %q", fu.in.ServerSideEncryption, aws.ToString(fu.in.SSEKMSKeyId))
+	}
+	if aws.ToString(fu.in.Tagging) != "team=a" {
+		t.Errorf("Tagging = %q", aws.ToString(fu.in.Tagging))
+	}
+
+	want := map[string]string{
+		"ccmd-version": "1.2.3",
+		"command":      "echo+h%C3%A9llo%0Aworld",
+		"long":         strings.Repeat("x", 509) + "...",
+	}
+	if !reflect.DeepEqual(fu.in.Metadata, want) {
+		t.Errorf("Metadata = %v; want %v", fu.in.Metadata, want)
+	}
+}
+
+// rangeS3 serves one object, honouring Range and If-Match like S3 does
+type rangeS3 struct {
+	mu          sync.Mutex
+	data        []byte
+	etag        string
+	inFlight    int
+	maxInFlight int
+	requests    int
+	breakBody   map[string]bool // ranges whose body breaks off the first time
+	replaceWith []byte          // replaces the object after the first request
+}
+
+func (f *rangeS3) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	f.requests++
+	f.inFlight++
+	f.maxInFlight = max(f.maxInFlight, f.inFlight)
+	data, etag := f.data, f.etag
+	if f.replaceWith != nil && f.requests == 2 {
+		f.data, f.etag = f.replaceWith, `"replaced"`
+		data, etag = f.data, f.etag
+	}
+	broken := f.breakBody[aws.ToString(in.Range)]
+	delete(f.breakBody, aws.ToString(in.Range))
+	f.mu.Unlock()
+
+	// give other parts a chance to start
+	time.Sleep(5 * time.Millisecond)
+
+	f.mu.Lock()
+	f.inFlight--
+	f.mu.Unlock()
+
+	if in.IfMatch != nil && aws.ToString(in.IfMatch) != etag {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+
+	if in.Range == nil {
+		return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data)), ETag: aws.String(etag)}, nil
+	}
+
+	var start, end int64
+	fmt.Sscanf(aws.ToString(in.Range), "bytes=%d-%d", &start, &end)
+	end = min(end, int64(len(data))-1)
+
+	var body io.Reader = bytes.NewReader(data[start : end+1])
+	if broken {
+		body = io.MultiReader(bytes.NewReader(data[start:start+10]), errReader{err: errors.New("connection reset")})
+	}
+
+	return &s3.GetObjectOutput{
+		Body:         io.NopCloser(body),
+		ContentRange: aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(data))),
+		ETag:         aws.String(etag),
+	}, nil
+}
+
+func (f *rangeS3) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(f.data))), ETag: aws.String(f.etag)}, nil
+}
+
+func randomData(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGetEntryRanged(t *testing.T) {
+	const part = 5 << 20
+	data := randomData(t, 4*part+1234)
+	f := &rangeS3{
+		data:      data,
+		etag:      `"v1"`,
+		breakBody: map[string]bool{byteRange(2*part, part): true},
+	}
+	c := fromURI("s3://mybucket?part_size=5MiB&concurrency=3")
+	c.Client = f
+
+	rc, err := c.GetEntry("mykey")
+	if err != nil {
+		t.Fatalf("GetEntry returned error: %v", err)
+	}
+	defer rc.Close()
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading entry: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("downloaded %d bytes that do not match the %d stored", len(got), len(data))
+	}
+
+	// 5 parts and one retry of the broken part
+	if f.requests != 6 {
+		t.Errorf("requests = %d; want 6", f.requests)
+	}
+	if f.maxInFlight < 2 || f.maxInFlight > 4 {
+		t.Errorf("max parts in flight = %d; want parallel downloads limited by concurrency", f.maxInFlight)
+	}
+}
+
+func TestGetEntryRangedSmall(t *testing.T) {
+	data := randomData(t, 1000)
+	f := &rangeS3{data: data, etag: `"v1"`}
+	c := fromURI("s3://mybucket")
+	c.Client = f
+
+	rc, err := c.GetEntry("mykey")
+	if err != nil {
+		t.Fatalf("GetEntry returned error: %v", err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+
+	if !bytes.Equal(got, data) || f.requests != 1 {
+		t.Errorf("got %d bytes in %d requests; want %d bytes in one request", len(got), f.requests, len(data))
+	}
+}
+
+func TestGetEntryRangedReplaced(t *testing.T) {
+	const part = 5 << 20
+	f := &rangeS3{
+		data:        randomData(t, 2*part),
+		etag:        `"v1"`,
+		replaceWith: randomData(t, 2*part),
+	}
+	c := fromURI("s3://mybucket?part_size=5MiB")
+	c.Client = f
+
+	rc, err := c.GetEntry("mykey")
+	if err != nil {
+		t.Fatalf("GetEntry returned error: %v", err)
+	}
+	defer rc.Close()
+
+	_, err = io.ReadAll(rc)
+	if err == nil || !strings.Contains(err.Error(), "PreconditionFailed") {
+		t.Errorf("err = %v; mixing parts of two versions must fail", err)
+	}
+}
+
+// fakeAccess is a bucket with a policy, failing each operation with the
+// given error
+type fakeAccess struct {
+	headErr, getErr, putErr error
+	noListBucket            bool // missing keys are AccessDenied, like S3 without s3:ListBucket
+	lost                    bool // written objects are not found, e.g. removed by a lifecycle rule
+
+	objects map[string]bool
+	puts    []*s3.PutObjectInput
+	deleted []string
+}
+
+func (f *fakeAccess) HeadBucket(_ context.Context, in *s3.HeadBucketInput, _ ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, f.headErr
+}
+
+func (f *fakeAccess) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if f.getErr != nil {
+		return nil, f.getErr
+	}
+	if !f.objects[aws.ToString(in.Key)] {
+		if f.noListBucket {
+			return nil, &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}
+		}
+		return nil, &smithy.GenericAPIError{Code: "NoSuchKey"}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("ccmd"))}, nil
+}
+
+func (f *fakeAccess) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if f.putErr != nil {
+		return nil, f.putErr
+	}
+	f.puts = append(f.puts, in)
+	if f.objects == nil {
+		f.objects = map[string]bool{}
+	}
+	f.objects[aws.ToString(in.Key)] = !f.lost
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeAccess) DeleteObject(_ context.Context, in *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.deleted = append(f.deleted, aws.ToString(in.Key))
+	delete(f.objects, aws.ToString(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestCheckAccess(t *testing.T) {
+	denied := &smithy.GenericAPIError{Code: "AccessDenied", Message: "Access Denied"}
+	const (
+		ok      = internal.AccessAllowed
+		no      = internal.AccessDenied
+		unknown = internal.AccessUnknown
+	)
+
+	tests := []struct {
+		name      string
+		access    *fakeAccess
+		wantRead  internal.Access
+		wantWrite internal.Access
+		wantErr   string
+	}{
+		{"readWrite", &fakeAccess{}, ok, ok, ""},
+		{"noListBucket", &fakeAccess{headErr: &smithy.GenericAPIError{Code: "Forbidden"}}, ok, ok, ""},
+		{"readOnly", &fakeAccess{putErr: denied}, ok, no, ""},
+		{"writeOnly", &fakeAccess{getErr: denied}, no, ok, ""},
+		{"writeOnlyNoListBucket", &fakeAccess{getErr: denied, noListBucket: true}, no, ok, ""},
+		// a denied read cannot be told apart from a missing probe
+		{"readOnlyNoListBucket", &fakeAccess{putErr: denied, noListBucket: true}, unknown, no, ""},
+		{"noneInconclusive", &fakeAccess{putErr: denied, getErr: denied}, unknown, no, ""},
+		{"probeLost", &fakeAccess{lost: true}, unknown, ok, ""},
+		{"noBucket", &fakeAccess{headErr: &smithy.GenericAPIError{Code: "NotFound"}}, no, no, `bucket "mybucket" does not exist`},
+		{"otherError", &fakeAccess{putErr: &smithy.GenericAPIError{Code: "SlowDown", Message: "Please reduce your request rate."}}, no, no, "S3 API error SlowDown: Please reduce your request rate."},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := fromURI("s3://mybucket/team")
+			c.AccessClient = tc.access
+
+			read, write, err := c.CheckAccess()
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("err = %v; want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckAccess returned error: %v", err)
+			}
+
+			if read != tc.wantRead || write != tc.wantWrite {
+				t.Errorf("read, write = %v, %v; want %v, %v", read, write, tc.wantRead, tc.wantWrite)
+			}
+
+			// the probe is cleaned up, and kept out of the way of entries
+			for key, present := range tc.access.objects {
+				if present {
+					t.Errorf("probe left behind: %s", key)
+				}
+			}
+			if write == ok && (len(tc.access.deleted) != 1 || !probeKeyPattern.MatchString(tc.access.deleted[0])) {
+				t.Errorf("deleted %v; want the probe under the prefix", tc.access.deleted)
+			}
+		})
+	}
+}
+
+var probeKeyPattern = regexp.MustCompile(`^team/\.ccmd-access-probe-[0-9a-f]{16}$`)
+
+func TestCheckAccessProbe(t *testing.T) {
+	access := &fakeAccess{}
+	c := fromURI("s3://mybucket/team?storage_class=STANDARD_IA&sse=aws:kms&sse_kms_key_id=mykey&tags=team=a")
+	c.AccessClient = access
+
+	if _, _, err := c.CheckAccess(); err != nil {
+		t.Fatalf("CheckAccess returned error: %v", err)
+	}
+	if _, _, err := c.CheckAccess(); err != nil {
+		t.Fatalf("CheckAccess returned error: %v", err)
+	}
+
+	// written like an entry, so policies on entries apply to the probe too
+	put := access.puts[0]
+	if put.StorageClass != types.StorageClassStandardIa || put.ServerSideEncryption != types.ServerSideEncryptionAwsKms ||
+		aws.ToString(put.SSEKMSKeyId) != "mykey" || aws.ToString(put.Tagging) != "team=a" {
+		t.Errorf("probe written with storage class %q, SSE %q, KMS key %q, tags %q", put.StorageClass, put.ServerSideEncryption, aws.ToString(put.SSEKMSKeyId), aws.ToString(put.Tagging))
+	}
+
+	// parallel jobs must not share a probe
+	if aws.ToString(access.puts[0].Key) == aws.ToString(access.puts[1].Key) {
+		t.Errorf("both checks used the probe %s", aws.ToString(access.puts[0].Key))
+	}
+}
+
+func TestHas(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		want    bool
+		wantErr string
+	}{
+		{"present", nil, true, ""},
+		{"missing", &smithy.GenericAPIError{Code: "NotFound"}, false, ""},
+		{"noBucket", &smithy.GenericAPIError{Code: "NoSuchBucket"}, false, `bucket "mybucket" does not exist`},
+		{"denied", &smithy.GenericAPIError{Code: "Forbidden", Message: "Forbidden"}, false, "S3 API error Forbidden: Forbidden"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := fromURI("s3://mybucket")
+			c.Client = &fakeS3{err: tc.err}
+
+			got, err := c.Has("mykey")
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("err = %v; want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Errorf("Has = %v, %v; want %v", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestParsedParts(t *testing.T) {
+	// only the parts are used, URI is not parsed again
+	c := &S3Cache{
+		URI:    "s3://ignored",
+		Bucket: "mybucket",
+		Prefix: "/team/a/",
+		Query:  url.Values{"region": {"eu-west-1"}, "part_size": {"8MiB"}},
+	}
+
+	if got := c.GetBucketName(); got != "mybucket" {
+		t.Errorf("bucket = %q; want mybucket", got)
+	}
+	if got := c.getObjectKey("mykey"); got != "team/a/mykey" {
+		t.Errorf("object key = %q; want team/a/mykey", got)
+	}
+
+	opts, err := c.GetOptions()
+	if err != nil {
+		t.Fatalf("GetOptions returned error: %v", err)
+	}
+	if opts.Region != "eu-west-1" || opts.PartSize != 8<<20 {
+		t.Errorf("region = %q, part size = %d; want eu-west-1, 8MiB", opts.Region, opts.PartSize)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate returned error: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	defaultPartSize    = 16 * 1024 * 1024
+	defaultConcurrency = 4
+
+	// attempts at downloading a part, the SDK only retries failed requests
+	// and not bodies that break off halfway
+	partAttempts = 3
+)
+
+// byteRange is the Range header for the part of size bytes starting at start.
+func byteRange(start int64, size int64) string {
+	return fmt.Sprintf("bytes=%d-%d", start, start+size-1)
+}
+
+// objectSize reads the total size from a Content-Range header, e.g.
+// "bytes 0-99/1234".
+func objectSize(contentRange *string) (int64, bool) {
+	if contentRange == nil {
+		return 0, false
+	}
+
+	_, total, ok := strings.Cut(aws.ToString(contentRange), "/")
+	if !ok {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(total, 10, 64)
+	return size, err == nil
+}
+
+// rangedReader streams an object that is downloaded in parts, several at a
+// time, handing them out in order. At most concurrency parts are held in
+// memory.
+type rangedReader struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	client S3API
+	input  s3.GetObjectInput // bucket, key and the ETag of the first part
+
+	size        int64
+	partSize    int64
+	concurrency int
+
+	current io.ReadCloser     // the part being read
+	pending []chan partResult // parts being downloaded, in order
+	next    int64             // offset of the next part to start
+}
+
+type partResult struct {
+	data []byte
+	err  error
+}
+
+// newRangedReader continues the download of an object after its first part,
+// which is streamed from first.
+func newRangedReader(client S3API, input s3.GetObjectInput, first io.ReadCloser, size int64, partSize int64, concurrency int) *rangedReader {
+	ctx, cancel := context.WithCancel(context.TODO())
+
+	r := &rangedReader{
+		ctx:         ctx,
+		cancel:      cancel,
+		client:      client,
+		input:       input,
+		size:        size,
+		partSize:    partSize,
+		concurrency: concurrency,
+		current:     first,
+		next:        partSize,
+	}
+
+	r.fill()
+	return r
+}
+
+// fill starts downloads until concurrency parts are in flight.
+func (r *rangedReader) fill() {
+	for len(r.pending) < r.concurrency && r.next < r.size {
+		result := make(chan partResult, 1)
+		r.pending = append(r.pending, result)
+
+		start, size := r.next, min(r.partSize, r.size-r.next)
+		r.next += size
+
+		go func() {
+			data, err := r.downloadPart(start, size)
+			result <- partResult{data: data, err: err}
+		}()
+	}
+}
+
+func (r *rangedReader) downloadPart(start int64, size int64) ([]byte, error) {
+	input := r.input
+	input.Range = aws.String(byteRange(start, size))
+
+	var err error
+	for attempt := 0; attempt < partAttempts; attempt++ {
+		var output *s3.GetObjectOutput
+		output, err = r.client.GetObject(r.ctx, &input)
+		if err != nil {
+			// a changed ETag means the entry was replaced mid-download,
+			// which retrying cannot fix
+			return nil, err
+		}
+
+		buf := bytes.NewBuffer(make([]byte, 0, size))
+		_, err = io.Copy(buf, output.Body)
+		output.Body.Close()
+
+		if err == nil && int64(buf.Len()) != size {
+			err = fmt.Errorf("got %d bytes for part at offset %d; want %d", buf.Len(), start, size)
+		}
+		if err == nil {
+			return buf.Bytes(), nil
+		}
+		if r.ctx.Err() != nil {
+			return nil, r.ctx.Err()
+		}
+	}
+
+	return nil, err
+}
+
+func (r *rangedReader) Read(p []byte) (int, error) {
+	for {
+		if r.current != nil {
+			n, err := r.current.Read(p)
+			if err != io.EOF {
+				return n, err
+			}
+
+			r.current.Close()
+			r.current = nil
+			if n > 0 {
+				return n, nil
+			}
+		}
+
+		if len(r.pending) == 0 {
+			return 0, io.EOF
+		}
+
+		result := <-r.pending[0]
+		r.pending = r.pending[1:]
+		if result.err != nil {
+			return 0, fmt.Errorf("downloading entry: %w", result.err)
+		}
+
+		r.current = io.NopCloser(bytes.NewReader(result.data))
+		r.fill()
+	}
+}
+
+func (r *rangedReader) Close() error {
+	r.cancel()
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
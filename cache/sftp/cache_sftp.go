@@ -0,0 +1,286 @@
+package sftp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+
+	sftpclient "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPCache stores entries as files on a host reachable over SSH, named in
+// the URI as sftp://user@host[:port]/path. Paths starting with /~/ are
+// relative to the user's home directory.
+//
+// Like ssh, it authenticates with the keys in the ssh-agent, or unencrypted
+// default keys in ~/.ssh, and only connects to hosts in known_hosts.
+type SFTPCache struct {
+	URI string
+
+	User string // empty for the current user
+	Host string // host[:port]
+	Path string
+
+	Client *sftpclient.Client // tests inject, otherwise we connect
+}
+
+// default identity files, in the order ssh tries them
+var identityFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+func (s *SFTPCache) Validate() error {
+	if (&url.URL{Host: s.Host}).Hostname() == "" {
+		return errors.New("URI must include a host")
+	}
+
+	if s.GetDirectory() == "" || s.GetDirectory() == "/" {
+		return errors.New("URI must include a directory, e.g. sftp://host/var/cache/ccmd")
+	}
+
+	return nil
+}
+
+func (s *SFTPCache) GetFriendlyName() string {
+	return "sftp"
+}
+
+// GetDirectory is the directory entries are stored in on the host.
+func (s *SFTPCache) GetDirectory() string {
+	// SFTP resolves relative paths against the home directory
+	if rest, ok := strings.CutPrefix(s.Path, "/~/"); ok {
+		return strings.TrimSuffix(rest, "/")
+	}
+
+	return strings.TrimSuffix(s.Path, "/")
+}
+
+func (s *SFTPCache) getEntryPath(key string) string {
+	return path.Join(s.GetDirectory(), key)
+}
+
+func (s *SFTPCache) getClient() (*sftpclient.Client, error) {
+	if s.Client != nil {
+		return s.Client, nil
+	}
+
+	username := s.User
+	address := &url.URL{Host: s.Host}
+
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = current.Username
+	}
+
+	hostKeyCallback, err := knownHostsCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := authMethods()
+	if err != nil {
+		return nil, err
+	}
+
+	port := address.Port()
+	if port == "" {
+		port = "22"
+	}
+
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(address.Hostname(), port), &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftpclient.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s.Client = client
+	return s.Client, nil
+}
+
+func sshDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ssh"), nil
+}
+
+func knownHostsCallback() (ssh.HostKeyCallback, error) {
+	var files []string
+
+	if dir, err := sshDir(); err == nil {
+		files = append(files, filepath.Join(dir, "known_hosts"))
+	}
+	files = append(files, "/etc/ssh/ssh_known_hosts")
+
+	var existing []string
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+
+	if len(existing) == 0 {
+		return nil, errors.New("no known_hosts file found, add the host with ssh-keyscan")
+	}
+
+	return knownhosts.New(existing...)
+}
+
+func authMethods() ([]ssh.AuthMethod, error) {
+	var signers []ssh.Signer
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to ssh-agent: %w", err)
+		}
+
+		agentSigners, err := agent.NewClient(conn).Signers()
+		if err != nil {
+			return nil, fmt.Errorf("could not list ssh-agent keys: %w", err)
+		}
+		signers = append(signers, agentSigners...)
+	}
+
+	if dir, err := sshDir(); err == nil {
+		for _, name := range identityFiles {
+			pem, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				continue
+			}
+
+			// keys with a passphrase have to be added to the agent
+			signer, err := ssh.ParsePrivateKey(pem)
+			if err != nil {
+				continue
+			}
+			signers = append(signers, signer)
+		}
+	}
+
+	if len(signers) == 0 {
+		return nil, errors.New("no SSH keys found, start ssh-agent and add a key with ssh-add")
+	}
+
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, nil
+}
+
+func (s *SFTPCache) GetEntry(key string) (io.ReadCloser, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := client.Open(s.getEntryPath(key))
+	if err != nil {
+		return nil, s.fileError(err, key)
+	}
+
+	return file, nil
+}
+
+// Has checks for an entry by stat'ing its file.
+func (s *SFTPCache) Has(key string) (bool, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := client.Stat(s.getEntryPath(key)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, s.fileError(err, key)
+	}
+
+	return true, nil
+}
+
+func (s *SFTPCache) PutEntry(key string, body io.Reader) (int64, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := client.MkdirAll(s.GetDirectory()); err != nil {
+		return 0, s.fileError(err, key)
+	}
+
+	// upload under a temporary name, so readers never see a partial entry
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	tempPath := s.getEntryPath(key) + ".tmp-" + hex.EncodeToString(suffix)
+
+	file, err := client.Create(tempPath)
+	if err != nil {
+		return 0, s.fileError(err, key)
+	}
+
+	bytesWritten, err := file.ReadFrom(body)
+	closeErr := file.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.rename(client, tempPath, s.getEntryPath(key))
+	}
+
+	if err != nil {
+		client.Remove(tempPath)
+		return 0, s.fileError(err, key)
+	}
+
+	return bytesWritten, nil
+}
+
+// rename replaces newPath atomically where the server supports it. Plain
+// SFTP renames fail if the target exists, in which case the old entry is
+// removed first.
+func (s *SFTPCache) rename(client *sftpclient.Client, oldPath string, newPath string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldPath, newPath)
+	}
+
+	if err := client.Rename(oldPath, newPath); err == nil {
+		return nil
+	}
+
+	client.Remove(newPath)
+	return client.Rename(oldPath, newPath)
+}
+
+func (s *SFTPCache) fileError(err error, key string) error {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("entry %q not found in %s", key, s.GetDirectory())
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("permission denied for %s", s.GetDirectory())
+	default:
+		return err
+	}
+}
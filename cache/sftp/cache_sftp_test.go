@@ -0,0 +1,284 @@
+//go:build !windows
+
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sftpclient "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testHost is an in-process SSH server with the sftp subsystem, serving the
+// local filesystem
+type testHost struct {
+	addr      string
+	hostKey   ssh.PublicKey
+	clientKey ed25519.PrivateKey
+}
+
+func newSigner(t *testing.T) (ssh.Signer, ed25519.PrivateKey) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, priv
+}
+
+func startHost(t *testing.T) *testHost {
+	t.Helper()
+	hostSigner, _ := newSigner(t)
+	clientSigner, clientKey := newSigner(t)
+	authorized := clientSigner.PublicKey().Marshal()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, config)
+		}
+	}()
+
+	return &testHost{addr: listener.Addr().String(), hostKey: hostSigner.PublicKey(), clientKey: clientKey}
+}
+
+func serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				// the payload is the length prefixed subsystem name
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+
+				if ok {
+					server, err := sftpclient.NewServer(channel)
+					if err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+// setupHome points HOME at a fresh directory with a known_hosts file that
+// trusts hostKey
+func setupHome(t *testing.T, host *testHost, hostKey ssh.PublicKey) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{host.addr}, hostKey) + "\n"
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return home
+}
+
+// startAgent serves an ssh-agent holding key
+func startAgent(t *testing.T, key ed25519.PrivateKey) {
+	t.Helper()
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", socket)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		host    string
+		path    string
+		wantErr bool
+	}{
+		{"artefacts.example.com", "/var/cache/ccmd", false},
+		{"artefacts.example.com:2222", "/~/ccmd", false},
+
+		{"", "/var/cache/ccmd", true},
+		{":2222", "/var/cache/ccmd", true},
+		{"artefacts.example.com", "", true},
+		{"artefacts.example.com", "/", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.host+tc.path, func(t *testing.T) {
+			err := (&SFTPCache{Host: tc.host, Path: tc.path}).Validate()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Validate(%q, %q) err=%v, wantErr=%v", tc.host, tc.path, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetDirectory(t *testing.T) {
+	if d := (&SFTPCache{Host: "host", Path: "/var/cache/ccmd/"}).GetDirectory(); d != "/var/cache/ccmd" {
+		t.Errorf("absolute = %q", d)
+	}
+	if d := (&SFTPCache{Host: "host", Path: "/~/ccmd"}).GetDirectory(); d != "ccmd" {
+		t.Errorf("home relative = %q", d)
+	}
+}
+
+func TestPutEntryAndGetEntry(t *testing.T) {
+	host := startHost(t)
+	setupHome(t, host, host.hostKey)
+	startAgent(t, host.clientKey)
+
+	dir := filepath.Join(t.TempDir(), "cache")
+	s := &SFTPCache{User: "ci", Host: host.addr, Path: dir}
+
+	// the second upload replaces the first
+	for _, data := range []string{"first", "hello"} {
+		n, err := s.PutEntry("mykey", bytes.NewBufferString(data))
+		if err != nil {
+			t.Fatalf("PutEntry returned error: %v", err)
+		}
+		if n != int64(len(data)) {
+			t.Errorf("bytes = %d; want %d", n, len(data))
+		}
+	}
+
+	rc, err := s.GetEntry("mykey")
+	if err != nil {
+		t.Fatalf("GetEntry returned error: %v", err)
+	}
+	defer rc.Close()
+
+	data, _ := io.ReadAll(rc)
+	if string(data) != "hello" {
+		t.Errorf("data = %q; want %q", data, "hello")
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("cache directory has %d files; want only the entry, no temp files", len(files))
+	}
+
+	if ok, err := s.Has("mykey"); err != nil || !ok {
+		t.Errorf("Has(mykey) = %v, %v; want true", ok, err)
+	}
+	if ok, err := s.Has("other"); err != nil || ok {
+		t.Errorf("Has(other) = %v, %v; want false", ok, err)
+	}
+
+	_, err = s.GetEntry("other")
+	if err == nil || err.Error() != `entry "other" not found in `+dir {
+		t.Errorf("err = %v; want not found", err)
+	}
+}
+
+func TestIdentityFile(t *testing.T) {
+	host := startHost(t)
+	home := setupHome(t, host, host.hostKey)
+
+	block, err := ssh.MarshalPrivateKey(host.clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "id_ed25519"), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &SFTPCache{User: "ci", Host: host.addr, Path: t.TempDir()}
+	if _, err := s.PutEntry("mykey", bytes.NewBufferString("hello")); err != nil {
+		t.Fatalf("PutEntry returned error: %v", err)
+	}
+}
+
+func TestUnknownHostKey(t *testing.T) {
+	host := startHost(t)
+	otherKey, _ := newSigner(t)
+	setupHome(t, host, otherKey.PublicKey())
+	startAgent(t, host.clientKey)
+
+	s := &SFTPCache{User: "ci", Host: host.addr, Path: t.TempDir()}
+	_, err := s.GetEntry("mykey")
+	if err == nil || !strings.Contains(err.Error(), "key mismatch") {
+		t.Fatalf("err = %v; want a host key mismatch", err)
+	}
+}
+
+func TestNoKeys(t *testing.T) {
+	host := startHost(t)
+	setupHome(t, host, host.hostKey)
+
+	s := &SFTPCache{User: "ci", Host: host.addr, Path: t.TempDir()}
+	_, err := s.GetEntry("mykey")
+	if err == nil || err.Error() != "no SSH keys found, start ssh-agent and add a key with ssh-add" {
+		t.Fatalf("err = %v; want no keys", err)
+	}
+}
@@ -0,0 +1,39 @@
+package commands
+
+import (
+	"fmt"
+
+	"github.com/alexflint/go-arg"
+)
+
+type cliArgs struct {
+	CacheList *CacheListCmd   `arg:"subcommand:cache-list"`
+	Run       *RunCommandArgs `arg:"subcommand:run"`
+	Serve     *ServeCmd       `arg:"subcommand:serve"`
+
+	version string
+}
+
+func (a cliArgs) Version() string {
+	return fmt.Sprintf("ccmd %s", a.version)
+}
+
+// Main parses the command line and runs the chosen command. Wrapper binaries
+// call it after registering their own backends with cache.Register.
+func Main(runtime RuntimeInformation) {
+	args := cliArgs{version: runtime.Version}
+
+	arg.MustParse(&args)
+
+	switch {
+	case args.Run != nil:
+		RunCommand(args.Run, runtime)
+		return
+	case args.Serve != nil:
+		ServeCommand(args.Serve, runtime)
+		return
+	case args.CacheList != nil:
+		CacheListCommand()
+		return
+	}
+}
@@ -1,11 +1,17 @@
 package commands
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fatih/color"
@@ -20,11 +26,26 @@ var AppFs = afero.NewOsFs()
 var dimGrey = color.RGB(100, 100, 100)
 
 type RunCommandArgs struct {
-	Input            []string `arg:"-i,--input,required"`
-	Output           []string `arg:"required"`
-	Command          string   `arg:"required"`
-	WorkingDirectory string   `arg:"--cwd"`
-	Cache            []string `arg:"--cache"`
+	Input            []string      `arg:"-i,--input,required"`
+	Output           []string      `arg:"--output"`
+	Command          string        `arg:"--command"`
+	Shell            bool          `arg:"--shell"`
+	Args             []string      `arg:"positional"`
+	WorkingDirectory string        `arg:"--cwd"`
+	Cache            []string      `arg:"--cache"`
+	CacheRead        []string      `arg:"--cache-read"`
+	CacheWrite       []string      `arg:"--cache-write"`
+	CheckAccess      bool          `arg:"--check-access"`
+	CacheFailures    bool          `arg:"--cache-failures"`
+	FailureTTL       time.Duration `arg:"--failure-ttl" default:"1h"`
+	Timeout          time.Duration `arg:"--timeout"`
+	KillAfter        time.Duration `arg:"--kill-after" default:"10s"`
+	TTY              bool          `arg:"--tty"`
+	Env              []string      `arg:"--env"`
+	HermeticEnv      bool          `arg:"--hermetic-env"`
+	TraceInputs      bool          `arg:"--trace-inputs"`
+	StrictOutputs    bool          `arg:"--strict-outputs"`
+	StdoutTo         string        `arg:"--stdout-to"`
 }
 
 var profiling struct {
@@ -53,7 +74,7 @@ func RunCommand(args *RunCommandArgs, runtime RuntimeInformation) {
 	validateArgs(*args)
 
 	// if no cache providers are given, fall back to local cache
-	if len(args.Cache) == 0 {
+	if len(args.Cache) == 0 && len(args.CacheRead) == 0 && len(args.CacheWrite) == 0 {
 		args.Cache = []string{"local://test"}
 	}
 
@@ -61,12 +82,19 @@ func RunCommand(args *RunCommandArgs, runtime RuntimeInformation) {
 	fmt.Print("Using working directory: ")
 	color.Cyan(absoluteWorkingDirectory)
 
+	backends := openBackends(*args)
+
 	fmt.Print("Cache backends: ")
-	color.Cyan(strings.Join(args.Cache, ", "))
+	color.Cyan(describeBackends(backends))
+
+	if args.CheckAccess {
+		checkBackendAccess(backends)
+	}
 
 	// find matching input files
 	findFilesStart := time.Now()
-	inputFiles, err := internal.FindFiles(args.Input, args.Output, workingDirectory)
+	outputPatterns := declaredOutputs(*args)
+	inputFiles, err := internal.FindFiles(args.Input, outputPatterns, workingDirectory)
 	profiling.FindFiles = time.Since(findFilesStart)
 
 	if err != nil {
@@ -82,9 +110,16 @@ func RunCommand(args *RunCommandArgs, runtime RuntimeInformation) {
 
 	dimGrey.Printf("Found %d input files in %s\n", len(inputFiles), formatDuration(profiling.FindFiles))
 
+	// declared variables are part of the key, they may change the output
+	commandEnv := internal.LookupEnv(envAllowlist(*args))
+
+	if args.HermeticEnv {
+		dimGrey.Printf("Hermetic environment: %s\n", strings.Join(envAllowlist(*args), ", "))
+	}
+
 	// calculate hash of inputs
 	hashFilesStart := time.Now()
-	inputChecksum, err := internal.HashDir(AppFs, inputFiles, workingDirectory)
+	inputChecksum, err := internal.HashDir(AppFs, inputFiles, workingDirectory+internal.EnvFingerprint(commandEnv))
 	profiling.HashFiles = time.Since(hashFilesStart)
 
 	if err != nil {
@@ -96,49 +131,176 @@ func RunCommand(args *RunCommandArgs, runtime RuntimeInformation) {
 
 	// check cache
 	cacheLookupStart := time.Now()
-	cacheReader := cacheLookup(inputChecksum, args.Cache)
+	cacheReader := cacheLookup(inputChecksum, backends)
 	profiling.CacheLookup = time.Since(cacheLookupStart)
 
+	// a recent failure is replayed instead of running the command again
+	if cacheReader == nil && args.CacheFailures {
+		replayFailure(inputChecksum, backends, commandString(*args), workingDirectory)
+	}
+
 	// if cache exists, then extract
 	if cacheReader != nil {
 		// extract cache
 		cacheExtractStart := time.Now()
-		outputFiles, err := internal.ExtractArchive(cacheReader, workingDirectory)
+		outputFiles, manifest, err := internal.ExtractArchive(cacheReader, workingDirectory)
 		profiling.CacheExtract = time.Since(cacheExtractStart)
 
 		if err != nil {
+			cacheReader.Close()
 			fmt.Println(err)
 			os.Exit(1)
 		}
 
+		finishLookup(cacheReader)
+
+		// replay the terminal output, colours and all
+		if args.TTY && manifest != nil {
+			os.Stdout.Write(manifest.Log)
+		}
+
 		dimGrey.Printf("Found in cache: served %s\n", formatDuration(profiling.CacheLookup+profiling.CacheExtract))
 		printFileList(outputFiles, 10, "->")
 	} else { // otherwise execute command, then save
 		dimGrey.Printf("Cache miss: executing command...\n\n")
 
 		// run command
+		argv, err := commandArgv(*args)
+		if err != nil {
+			printError(fmt.Sprintf("invalid command: %s", err.Error()), 1)
+		}
+
+		// remember the tree, to find out what the command wrote
+		treeBefore, err := internal.SnapshotTree(workingDirectory)
+		if err != nil {
+			// without outputs, the snapshot is the only way to find them
+			if len(outputPatterns) == 0 {
+				printError(fmt.Sprintf("could not snapshot working directory: %s", err.Error()), 1)
+			}
+
+			dimGrey.Printf("Could not snapshot working directory: %s\n", err.Error())
+		}
+
 		fmt.Print("Running command: ")
-		color.Cyan(args.Command)
+		color.Cyan(commandString(*args))
+		inputsFile, err := internal.WriteFileList(inputFiles)
+		if err != nil {
+			fmt.Println("error occurred while writing the list of input files")
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+
+		// let the command know what it is running under
+		env := append(commandEnv,
+			"CCMD_CACHE_KEY="+inputChecksum,
+			"CCMD_WORKDIR="+absoluteWorkingDirectory,
+			"CCMD_INPUTS_FILE="+inputsFile,
+			"CCMD_VERSION="+runtime.Version,
+		)
+
+		// files the command reads, when tracing
+		var tracedReads []string
+		var traceReads func(string)
+		if args.TraceInputs {
+			traceReads = func(path string) { tracedReads = append(tracedReads, path) }
+		}
+
+		// stdout goes straight to its file, which is one of the outputs
+		var stdoutFile *os.File
+		if args.StdoutTo != "" {
+			stdoutFile, err = createStdoutFile(filepath.Join(workingDirectory, args.StdoutTo))
+			if err != nil {
+				os.Remove(inputsFile)
+				printError(fmt.Sprintf("could not create --stdout-to file: %s", err.Error()), 1)
+			}
+		}
+
 		commandExecutionStart := time.Now()
-		err := internal.RunCommand(args.Command, workingDirectory)
+		var commandLog bytes.Buffer
+		err = internal.RunCommand(argv, internal.CommandOptions{
+			WorkingDirectory: workingDirectory,
+			Env:              env,
+			Hermetic:         args.HermeticEnv,
+			Log:              &commandLog,
+			Timeout:          args.Timeout,
+			KillAfter:        args.KillAfter,
+			TTY:              args.TTY,
+			TraceReads:       traceReads,
+			Stdout:           writerOrNil(stdoutFile),
+		})
+		os.Remove(inputsFile)
+
+		// on failure the file keeps the partial output, as with a shell redirect
+		if stdoutFile != nil {
+			stdoutFile.Close()
+		}
 
 		if err != nil {
 			fmt.Println(err.Error())
-			os.Exit(1)
+
+			// only failures that depend on the inputs are worth remembering
+			var cmdErr *internal.CommandError
+			if args.CacheFailures && errors.As(err, &cmdErr) && !cmdErr.Interrupted && !cmdErr.TimedOut {
+				cacheFailure(inputChecksum, backends, args, runtime, cmdErr.ExitCode, commandLog.Bytes())
+			}
+
+			os.Exit(internal.ExitCode(err))
 		}
 
 		profiling.CommandExecution = time.Since(commandExecutionStart)
 
 		dimGrey.Printf("Command completed in %s\n", formatDuration(profiling.CommandExecution))
 
+		if args.TraceInputs {
+			warnUndeclaredInputs(tracedReads, inputFiles, outputPatterns, workingDirectory)
+		}
+
+		// files created or modified by the command
+		var changedFiles []string
+		var treeAfter internal.Snapshot
+		if treeBefore != nil {
+			treeAfter, err = internal.SnapshotTree(workingDirectory)
+			if err != nil {
+				// as before the run, only inferred outputs depend on it
+				if len(outputPatterns) == 0 {
+					printError(fmt.Sprintf("could not snapshot working directory: %s", err.Error()), 1)
+				}
+
+				dimGrey.Printf("Could not snapshot working directory: %s\n", err.Error())
+			} else {
+				changedFiles = treeBefore.Changes(treeAfter)
+			}
+		}
+
+		if len(outputPatterns) > 0 && treeAfter != nil {
+			checkUndeclaredOutputs(changedFiles, outputPatterns, args.StrictOutputs)
+		}
+
 		// capture output
 		profiling.CacheSaveStart = time.Now()
-		outputFiles, err := internal.FindFiles(args.Output, []string{}, workingDirectory)
-
-		if err != nil {
-			fmt.Println("error occured while searching for output files")
-			fmt.Println(err.Error())
-			os.Exit(1)
+		var outputFiles, inferredOutputs []string
+
+		if len(outputPatterns) == 0 {
+			inferredOutputs = changedFiles
+			for _, rel := range inferredOutputs {
+				outputFiles = append(outputFiles, filepath.Join(absoluteWorkingDirectory, rel))
+			}
+
+			if len(outputFiles) == 0 {
+				fmt.Println("command did not create or modify any files, nothing to save!")
+				os.Exit(1)
+			}
+
+			dimGrey.Printf("Inferred %d output files from changes to the working directory\n", len(outputFiles))
+			checkInferredOutputs(inferredOutputs, args.Input, args.StrictOutputs)
+		} else {
+			outputFiles, err = internal.FindFiles(outputPatterns, []string{}, workingDirectory)
+
+			if err != nil {
+				fmt.Println("error occured while searching for output files")
+				fmt.Println(err.Error())
+				os.Exit(1)
+			}
 		}
 
 		if len(outputFiles) == 0 {
@@ -146,13 +308,19 @@ func RunCommand(args *RunCommandArgs, runtime RuntimeInformation) {
 			os.Exit(1)
 		}
 
-		output, saveOutputErr := internal.CaptureOutput(outputFiles, inputChecksum, workingDirectory)
+		output, saveOutputErr := internal.CaptureOutput(outputFiles, &internal.Manifest{
+			Version:   runtime.Version,
+			Command:   commandString(*args),
+			CreatedAt: time.Now(),
+			Outputs:   inferredOutputs,
+			Log:       commandLog.Bytes(),
+		}, workingDirectory)
 		if saveOutputErr != nil {
 			fmt.Println("error occurred while saving output")
 			fmt.Println(saveOutputErr.Error())
 		}
 
-		cacheSave(inputChecksum, args.Cache, output)
+		cacheSave(inputChecksum, backends, output, entryMetadata(*args, runtime, len(inputFiles), profiling.CommandExecution), false)
 
 		printFileList(outputFiles, 10, "+")
 	}
@@ -183,8 +351,138 @@ func validateArgs(args RunCommandArgs) {
 		}
 	}
 
-	// validate cache providers
-	validateCacheBackends(args.Cache)
+	// validate environment variable names
+	for _, name := range args.Env {
+		if name == "" || strings.Contains(name, "=") {
+			printError(fmt.Sprintf("invalid environment variable name %q, --env takes names only", name), 1)
+		}
+	}
+
+	// validate command
+	switch {
+	case args.Command == "" && len(args.Args) == 0:
+		printError("No command given, use --command or pass it after --", 1)
+	case args.Command != "" && len(args.Args) > 0:
+		printError("Use either --command or pass the command after --, not both", 1)
+	case args.Shell && len(args.Args) > 0:
+		printError("--shell requires the command to be given with --command", 1)
+	}
+
+	if args.TTY && runtime.GOOS != "linux" {
+		printError("--tty is only supported on Linux", 1)
+	}
+
+	// validate stdout file
+	if args.StdoutTo != "" {
+		if filepath.IsAbs(args.StdoutTo) || !filepath.IsLocal(args.StdoutTo) {
+			printError("--stdout-to must be a path inside the working directory", 1)
+		}
+
+		if args.TTY {
+			printError("--stdout-to cannot be combined with --tty", 1)
+		}
+	}
+
+	if args.TraceInputs && runtime.GOOS != "linux" {
+		printError("--trace-inputs is only supported on Linux", 1)
+	}
+
+	if _, err := commandArgv(args); err != nil {
+		printError(fmt.Sprintf("invalid command: %s", err.Error()), 1)
+	}
+
+	// validate cache providers, without the mode ccmd uses them in
+	var caches []string
+	for _, spec := range backendSpecs(args) {
+		providerUri, _, _, err := spec.access()
+		if err != nil {
+			printError(fmt.Sprintf("validation error for %s: %s", spec.uri, err.Error()), 1)
+		}
+		caches = append(caches, providerUri)
+	}
+	validateCacheBackends(caches)
+}
+
+// commandArgv resolves the command to execute: argv given after -- is used
+// as-is, otherwise --command is run through the shell or split on quotes.
+func commandArgv(args RunCommandArgs) ([]string, error) {
+	if len(args.Args) > 0 {
+		return args.Args, nil
+	}
+
+	if args.Shell {
+		return internal.ShellCommand(args.Command), nil
+	}
+
+	argv, err := internal.SplitCommand(args.Command)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(argv) == 0 {
+		return nil, errors.New("command is empty")
+	}
+
+	return argv, nil
+}
+
+// declaredOutputs returns the output patterns, including the --stdout-to
+// file. If it is empty, outputs are inferred instead.
+func declaredOutputs(args RunCommandArgs) []string {
+	if args.StdoutTo == "" {
+		return args.Output
+	}
+
+	// a path rather than a pattern, so it must not be read as a glob
+	return append(append([]string{}, args.Output...), internal.QuotePattern(filepath.ToSlash(filepath.Clean(args.StdoutTo))))
+}
+
+func createStdoutFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	return os.Create(path)
+}
+
+// writerOrNil keeps a nil *os.File from becoming a non-nil io.Writer.
+func writerOrNil(f *os.File) io.Writer {
+	if f == nil {
+		return nil
+	}
+	return f
+}
+
+// envAllowlist lists the variables passed to a hermetic command. Their values
+// are folded into the cache key whether or not the environment is hermetic.
+func envAllowlist(args RunCommandArgs) []string {
+	if !args.HermeticEnv {
+		return args.Env
+	}
+
+	return append([]string{"PATH", "HOME"}, args.Env...)
+}
+
+// entryMetadata describes how an entry was produced, for backends that store
+// metadata alongside entries.
+func entryMetadata(args RunCommandArgs, runtime RuntimeInformation, inputCount int, duration time.Duration) map[string]string {
+	hostname, _ := os.Hostname()
+
+	return map[string]string{
+		"ccmd-version": runtime.Version,
+		"command":      commandString(args),
+		"input-count":  strconv.Itoa(inputCount),
+		"duration":     duration.Round(time.Millisecond).String(),
+		"hostname":     hostname,
+	}
+}
+
+func commandString(args RunCommandArgs) string {
+	if len(args.Args) > 0 {
+		return strings.Join(args.Args, " ")
+	}
+
+	return args.Command
 }
 
 func printFileList(files []string, maxFiles int, prefix string) {
@@ -226,50 +524,500 @@ func validateCacheBackends(caches []string) {
 	}
 }
 
-func cacheLookup(key string, caches []string) io.ReadCloser {
-	for _, cacheUri := range caches {
-		provider, err := cache.GetCacheProviderFromURI(cacheUri)
+// backend is a cache from --cache, with what ccmd is allowed to do with it.
+type backend struct {
+	uri      string
+	provider cache.CacheProvider
+	read     bool
+	write    bool
+}
+
+func (b *backend) String() string {
+	switch {
+	case !b.write:
+		return b.uri + " (read-only)"
+	case !b.read:
+		return b.uri + " (write-only)"
+	default:
+		return b.uri
+	}
+}
+
+func describeBackends(backends []*backend) string {
+	descriptions := make([]string, len(backends))
+	for i, b := range backends {
+		descriptions[i] = b.String()
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// backendSpec is a backend URI from the arguments, with the access its flag
+// allows.
+type backendSpec struct {
+	uri   string
+	read  bool
+	write bool
+}
+
+// backendSpecs lists the backends in lookup order: --cache, then the
+// read-only --cache-read and write-only --cache-write.
+func backendSpecs(args RunCommandArgs) []backendSpec {
+	var specs []backendSpec
+	for _, uri := range args.Cache {
+		specs = append(specs, backendSpec{uri: uri, read: true, write: true})
+	}
+	for _, uri := range args.CacheRead {
+		specs = append(specs, backendSpec{uri: uri, read: true})
+	}
+	for _, uri := range args.CacheWrite {
+		specs = append(specs, backendSpec{uri: uri, write: true})
+	}
+	return specs
+}
+
+// access combines the flag with the ?mode of the URI, and returns the URI
+// for the provider.
+func (spec backendSpec) access() (providerUri string, read bool, write bool, err error) {
+	providerUri, read, write, err = parseBackendMode(spec.uri)
+	if err != nil {
+		return "", false, false, err
+	}
+
+	read, write = read && spec.read, write && spec.write
+	if !read && !write {
+		return "", false, false, errors.New("can be neither read nor written, check its mode")
+	}
+
+	return providerUri, read, write, nil
+}
+
+// parseBackendMode reads ?mode=ro|wo|rw from a backend URI, and returns the
+// URI without it for the provider.
+func parseBackendMode(uri string) (providerUri string, read bool, write bool, err error) {
+	// local:// paths need not be valid URLs, e.g. on Windows
+	if !strings.Contains(uri, "?") {
+		return uri, true, true, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", false, false, err
+	}
+
+	query := u.Query()
+	if !query.Has("mode") {
+		return uri, true, true, nil
+	}
+
+	switch mode := query.Get("mode"); mode {
+	case "rw":
+		read, write = true, true
+	case "ro":
+		read = true
+	case "wo":
+		write = true
+	default:
+		return "", false, false, fmt.Errorf("invalid mode %q, must be ro, wo or rw", mode)
+	}
+
+	query.Del("mode")
+	u.RawQuery = query.Encode()
+	return u.String(), read, write, nil
+}
+
+// openBackends sets up the cache backends, in the mode given by their flag
+// and ?mode parameter.
+func openBackends(args RunCommandArgs) []*backend {
+	var backends []*backend
+
+	for _, spec := range backendSpecs(args) {
+		providerUri, read, write, err := spec.access()
+		if err != nil {
+			printError(fmt.Sprintf("invalid cache backend %s: %s", spec.uri, err.Error()), 1)
+		}
 
+		provider, err := cache.GetCacheProviderFromURI(providerUri)
 		if err != nil {
-			dimGrey.Printf("Invalid cache provider: %s\n", cacheUri)
-			return nil
+			printError(fmt.Sprintf("invalid cache provider: %s", err.Error()), 1)
 		}
 
-		result, err := provider.GetEntry(key)
+		backends = append(backends, &backend{
+			uri:      providerUri,
+			provider: provider,
+			read:     read,
+			write:    write,
+		})
+	}
+
+	return backends
+}
 
+// checkBackendAccess asks the providers that can about their permissions. A
+// backend that cannot be written is used read-only rather than failing the
+// build when saving.
+func checkBackendAccess(backends []*backend) {
+	for _, b := range backends {
+		checker, ok := b.provider.(cache.AccessChecker)
+		if !ok {
+			continue
+		}
+
+		read, write, err := checker.CheckAccess()
 		if err != nil {
-			dimGrey.Printf("Cache miss from %s: %s\n", cacheUri, err.Error())
+			printError(fmt.Sprintf("access check failed for %s: %s", b.uri, err.Error()), 1)
+		}
+
+		dimGrey.Printf("Access to %s: read %s / write %s\n", b.uri, read, write)
+
+		wantRead, wantWrite := b.read, b.write
+		b.read = b.read && read != internal.AccessDenied
+		b.write = b.write && write != internal.AccessDenied
+
+		switch {
+		case !b.read && !b.write:
+			printError(fmt.Sprintf("no access to %s, check the credentials", b.uri), 1)
+		case wantWrite && !b.write:
+			color.Yellow("Warning: cannot write to %s, using it read-only", b.uri)
+		case wantRead && !b.read:
+			color.Yellow("Warning: cannot read from %s, using it write-only", b.uri)
+		}
+	}
+}
+
+// cacheLookup returns the entry from the first backend that has it. The
+// entry is copied into the writable backends that missed as it is read, so
+// e.g. a hit from s3:// is served from local:// next time.
+func cacheLookup(key string, backends []*backend) io.ReadCloser {
+	var missed []*backend
+
+	for _, b := range backends {
+		if !b.read {
 			continue
 		}
 
-		dimGrey.Printf("Cache hit from %s\n", cacheUri)
+		result, err := b.provider.GetEntry(key)
 
-		return result
+		if err != nil {
+			dimGrey.Printf("Cache miss from %s: %s\n", b.uri, err.Error())
+			if b.write {
+				missed = append(missed, b)
+			}
+			continue
+		}
+
+		dimGrey.Printf("Cache hit from %s\n", b.uri)
+
+		if len(missed) == 0 {
+			return result
+		}
+		return newBackfillReader(key, result, missed)
 	}
 
 	return nil
 }
 
-func cacheSave(key string, caches []string, body io.Reader) {
-	for _, cacheUri := range caches {
-		provider, err := cache.GetCacheProviderFromURI(cacheUri)
+// backfillReader tees an entry into backends while it is read. The copies
+// are only kept if the entry was read to the end, and a backend that fails
+// is dropped without affecting the read.
+type backfillReader struct {
+	source  io.ReadCloser
+	targets []*backfillTarget
+	eof     bool
+	once    sync.Once
+}
 
-		if err != nil {
-			dimGrey.Printf("Invalid cache provider: %s\n", cacheUri)
-			return
+type backfillTarget struct {
+	backend *backend
+	pipe    *io.PipeWriter
+	done    chan error
+	failed  bool
+}
+
+func newBackfillReader(key string, source io.ReadCloser, backends []*backend) *backfillReader {
+	r := &backfillReader{source: source}
+
+	for _, b := range backends {
+		pr, pw := io.Pipe()
+		target := &backfillTarget{backend: b, pipe: pw, done: make(chan error, 1)}
+		r.targets = append(r.targets, target)
+
+		go func() {
+			_, err := b.provider.PutEntry(key, pr)
+			// unblocks the writer if the backend gave up early
+			pr.CloseWithError(err)
+			target.done <- err
+		}()
+	}
+
+	return r
+}
+
+func (r *backfillReader) Read(p []byte) (int, error) {
+	n, err := r.source.Read(p)
+
+	for _, target := range r.targets {
+		if n > 0 && !target.failed {
+			if _, werr := target.pipe.Write(p[:n]); werr != nil {
+				target.failed = true
+			}
+		}
+	}
+
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// Close waits for the copies to be stored, or aborts them if the entry was
+// not read to the end.
+func (r *backfillReader) Close() error {
+	err := r.source.Close()
+
+	r.once.Do(func() {
+		for _, target := range r.targets {
+			if r.eof {
+				target.pipe.Close()
+			} else {
+				target.pipe.CloseWithError(errors.New("entry was not read to the end"))
+			}
+		}
+
+		for _, target := range r.targets {
+			putErr := <-target.done
+			switch {
+			case !r.eof:
+			case putErr != nil:
+				color.Yellow("Warning: could not copy entry to %s: %s", target.backend.uri, putErr.Error())
+			default:
+				dimGrey.Printf("Copied entry to %s\n", target.backend.uri)
+			}
+		}
+	})
+
+	return err
+}
+
+// finishLookup reads what extracting left of an entry, such as gzip
+// padding, so that it is copied whole into earlier tiers, and closes it.
+func finishLookup(reader io.ReadCloser) {
+	io.Copy(io.Discard, reader)
+	reader.Close()
+}
+
+// cacheSave uploads body to every writable backend. Unless replace is set,
+// backends where another run already stored key are skipped, as happens when
+// parallel CI jobs build the same inputs. With several backends to upload to,
+// the archive is spooled to a temporary file so that it is only built once.
+func cacheSave(key string, backends []*backend, body io.Reader, metadata map[string]string, replace bool) {
+	var targets []*backend
+	writable := false
+
+	for _, b := range backends {
+		if !b.write {
+			continue
+		}
+		writable = true
+
+		if !replace {
+			if present, err := b.provider.Has(key); err == nil && present {
+				dimGrey.Printf("Result already stored in %s by another run, skipped upload\n", b.uri)
+				continue
+			}
+		}
+
+		targets = append(targets, b)
+	}
+
+	if len(targets) == 0 {
+		// the archive is only built as it is read, closing skips it
+		if closer, ok := body.(io.Closer); ok {
+			closer.Close()
 		}
 
-		bytesWritten, err := provider.PutEntry(key, body)
+		if !writable {
+			dimGrey.Printf("No writable cache backend, result not stored\n")
+		}
+		return
+	}
 
+	var spool *os.File
+	if len(targets) > 1 {
+		var err error
+		spool, err = spoolEntry(body)
 		if err != nil {
 			fmt.Println("error occurred while saving cache: ", err.Error())
 			os.Exit(1)
 		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+	}
+
+	stored := 0
+	for _, b := range targets {
+		reader := body
+		if spool != nil {
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				fmt.Println("error occurred while saving cache: ", err.Error())
+				os.Exit(1)
+			}
+			reader = spool
+		}
+
+		bytesWritten, err := cache.PutEntry(b.provider, key, reader, metadata)
+
+		if err != nil {
+			color.Yellow("Warning: could not store result in %s: %s", b.uri, err.Error())
+			continue
+		}
+		stored++
 
 		profiling.CacheSave = time.Since(profiling.CacheSaveStart)
 
-		dimGrey.Printf("Stored result (%s) in cache in %s\n", internal.ByteCountSI(bytesWritten), formatDuration(profiling.CacheSave))
+		dimGrey.Printf("Stored result (%s) in %s in %s\n", internal.ByteCountSI(bytesWritten), b.uri, formatDuration(profiling.CacheSave))
+	}
+
+	if stored == 0 {
+		printError("could not store result in any cache backend", 1)
+	}
+}
 
+// spoolEntry writes body to a temporary file, for uploading it several times.
+func spoolEntry(body io.Reader) (*os.File, error) {
+	spool, err := os.CreateTemp("", "ccmd-entry-*.tar.gz")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(spool, body); err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, err
+	}
+
+	return spool, nil
+}
+
+func warnUndeclaredInputs(reads []string, inputFiles []string, outputPatterns []string, workingDirectory string) {
+	undeclared, err := internal.UndeclaredInputs(reads, inputFiles, outputPatterns, workingDirectory)
+	if err != nil {
+		dimGrey.Printf("Could not check traced files: %s\n", err.Error())
 		return
 	}
+
+	if len(undeclared) == 0 {
+		dimGrey.Printf("All files read by the command are declared inputs\n")
+		return
+	}
+
+	color.Yellow("Warning: %d files were read by the command but not matched by --input:", len(undeclared))
+	printFileList(undeclared, 10, "?")
+}
+
+// checkUndeclaredOutputs reports files the command created or modified that
+// are not matched by --output, since a cache hit would not restore them.
+func checkUndeclaredOutputs(changedFiles []string, outputPatterns []string, strict bool) {
+	undeclared := internal.Unmatched(changedFiles, outputPatterns)
+	if len(undeclared) == 0 {
+		return
+	}
+
+	color.Yellow("Warning: %d files were written by the command but not matched by --output:", len(undeclared))
+	printFileList(undeclared, 10, "!")
+
+	if strict {
+		printError("Undeclared outputs are not allowed with --strict-outputs", 1)
+	}
+}
+
+// inferredInputs returns the inferred outputs that are also matched by the
+// input patterns. Declared outputs are excluded from the inputs, inferred
+// ones are not, so these would change the key of the next run.
+func inferredInputs(inferredOutputs []string, inputPatterns []string) []string {
+	var overlapping []string
+	for _, rel := range inferredOutputs {
+		if internal.MatchesAny(rel, inputPatterns) {
+			overlapping = append(overlapping, rel)
+		}
+	}
+	return overlapping
+}
+
+// checkInferredOutputs reports inferred outputs matched by --input, since the
+// entry stored for this run would never be hit.
+func checkInferredOutputs(inferredOutputs []string, inputPatterns []string, strict bool) {
+	overlapping := inferredInputs(inferredOutputs, inputPatterns)
+	if len(overlapping) == 0 {
+		return
+	}
+
+	color.Yellow("Warning: %d inferred output files are matched by --input, the next run will compute a different cache key:", len(overlapping))
+	printFileList(overlapping, 10, "!")
+	dimGrey.Printf("Declare them with --output to exclude them from the inputs\n")
+
+	if strict {
+		printError("Inferred outputs matching --input are not allowed with --strict-outputs", 1)
+	}
+}
+
+// failureKey is where a failed run of key is stored, so that it never shadows
+// a successful entry.
+func failureKey(key string) string {
+	return key + "-failed"
+}
+
+func cacheFailure(key string, backends []*backend, args *RunCommandArgs, runtime RuntimeInformation, exitCode int, log []byte) {
+	profiling.CacheSaveStart = time.Now()
+
+	now := time.Now()
+	output, err := internal.CaptureOutput([]string{}, &internal.Manifest{
+		Version:   runtime.Version,
+		Command:   commandString(*args),
+		ExitCode:  exitCode,
+		CreatedAt: now,
+		ExpiresAt: now.Add(args.FailureTTL),
+		Log:       log,
+	}, "")
+
+	if err != nil {
+		fmt.Println("error occurred while saving failure")
+		fmt.Println(err.Error())
+		return
+	}
+
+	// an expired failure is still present, and has to be replaced
+	cacheSave(failureKey(key), backends, output, nil, true)
+}
+
+func replayFailure(key string, backends []*backend, command string, workingDirectory string) {
+	cacheReader := cacheLookup(failureKey(key), backends)
+	if cacheReader == nil {
+		return
+	}
+	// aborts copying the entry to earlier tiers, unless finished below
+	defer cacheReader.Close()
+
+	_, manifest, err := internal.ExtractArchive(cacheReader, workingDirectory)
+	if err != nil || manifest == nil {
+		dimGrey.Printf("Ignoring unreadable cached failure\n")
+		return
+	}
+
+	if manifest.Expired(time.Now()) {
+		dimGrey.Printf("Cached failure expired at %s, re-running\n", manifest.ExpiresAt.Format(time.RFC3339))
+		return
+	}
+
+	// the command is not part of the key, and fixing it should not replay
+	// the failure of the old one
+	if manifest.Command != command {
+		dimGrey.Printf("Cached failure is of a different command, re-running\n")
+		return
+	}
+
+	dimGrey.Printf("Cached failure from %s: command exited with code %d\n\n", manifest.CreatedAt.Format(time.RFC3339), manifest.ExitCode)
+	os.Stdout.Write(manifest.Log)
+
+	finishLookup(cacheReader)
+	os.Exit(manifest.ExitCode)
 }
@@ -0,0 +1,248 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/simse/ccmd/cache"
+	"github.com/simse/ccmd/internal"
+	"github.com/spf13/afero"
+)
+
+func TestInferredInputs(t *testing.T) {
+	inferred := []string{"dist/app.js", "src/gen/api.ts", "README.md"}
+
+	tests := []struct {
+		name   string
+		inputs []string
+		want   []string
+	}{
+		{"everything", []string{"**"}, inferred},
+		{"sources", []string{"src/**/*.ts"}, []string{"src/gen/api.ts"}},
+		{"disjoint", []string{"lib/**", "package.json"}, nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := inferredInputs(inferred, tc.inputs); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("inferredInputs = %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// memoryBackend is a local cache in memory.
+func memoryBackend(t *testing.T, uri string) (*backend, *internal.LocalCache) {
+	t.Helper()
+	local := &internal.LocalCache{URI: uri, FS: afero.NewMemMapFs()}
+	return &backend{uri: uri, provider: local, read: true, write: true}, local
+}
+
+// brokenProvider misses every lookup and fails every write without reading.
+type brokenProvider struct{}
+
+func (brokenProvider) GetEntry(string) (io.ReadCloser, error)    { return nil, errors.New("miss") }
+func (brokenProvider) PutEntry(string, io.Reader) (int64, error) { return 0, errors.New("disk full") }
+func (brokenProvider) Has(string) (bool, error)                  { return false, nil }
+func (brokenProvider) GetFriendlyName() string                   { return "broken" }
+func (brokenProvider) Validate() error                           { return nil }
+
+func readEntry(t *testing.T, provider cache.CacheProvider, key string) []byte {
+	t.Helper()
+	rc, err := provider.GetEntry(key)
+	if err != nil {
+		t.Fatalf("GetEntry(%q) returned error: %v", key, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// assertEmpty checks that nothing, not even a temp file, was stored.
+func assertEmpty(t *testing.T, local *internal.LocalCache, dir string) {
+	t.Helper()
+	files, _ := afero.ReadDir(local.FS, dir)
+	if len(files) != 0 {
+		t.Errorf("%s has %d files; want none", local.URI, len(files))
+	}
+}
+
+func TestCacheLookupBackfill(t *testing.T) {
+	near, nearCache := memoryBackend(t, "local:///near")
+	far, farCache := memoryBackend(t, "local:///far")
+	data := bytes.Repeat([]byte("entry "), 100000)
+	farCache.PutEntry("key", bytes.NewReader(data))
+
+	reader := cacheLookup("key", []*backend{near, far})
+	if reader == nil {
+		t.Fatal("cacheLookup missed")
+	}
+
+	got, _ := io.ReadAll(reader)
+	finishLookup(reader)
+
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes that do not match the %d stored", len(got), len(data))
+	}
+	if copied := readEntry(t, nearCache, "key"); !bytes.Equal(copied, data) {
+		t.Errorf("copied %d bytes that do not match the %d stored", len(copied), len(data))
+	}
+}
+
+func TestCacheLookupBackfillPartialRead(t *testing.T) {
+	near, nearCache := memoryBackend(t, "local:///near")
+	far, farCache := memoryBackend(t, "local:///far")
+	farCache.PutEntry("key", bytes.NewReader(bytes.Repeat([]byte("entry "), 100000)))
+
+	reader := cacheLookup("key", []*backend{near, far})
+	io.ReadFull(reader, make([]byte, 1000))
+	reader.Close()
+
+	assertEmpty(t, nearCache, "/near")
+}
+
+func TestCacheLookupBackfillExtractError(t *testing.T) {
+	near, nearCache := memoryBackend(t, "local:///near")
+	far, farCache := memoryBackend(t, "local:///far")
+	farCache.PutEntry("key", bytes.NewReader(bytes.Repeat([]byte("not an archive "), 100000)))
+
+	reader := cacheLookup("key", []*backend{near, far})
+	if _, _, err := internal.ExtractArchive(reader, t.TempDir()); err == nil {
+		t.Fatal("ExtractArchive did not fail")
+	}
+	reader.Close()
+
+	assertEmpty(t, nearCache, "/near")
+}
+
+func TestCacheLookupBackfillFailingTarget(t *testing.T) {
+	broken := &backend{uri: "broken://", provider: brokenProvider{}, read: true, write: true}
+	near, nearCache := memoryBackend(t, "local:///near")
+	far, farCache := memoryBackend(t, "local:///far")
+	data := bytes.Repeat([]byte("entry "), 100000)
+	farCache.PutEntry("key", bytes.NewReader(data))
+
+	reader := cacheLookup("key", []*backend{broken, near, far})
+	got, err := io.ReadAll(reader)
+	finishLookup(reader)
+
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v; want the entry despite the broken backend", len(got), err)
+	}
+	if copied := readEntry(t, nearCache, "key"); !bytes.Equal(copied, data) {
+		t.Errorf("copied %d bytes that do not match the %d stored", len(copied), len(data))
+	}
+}
+
+func TestCacheSaveEveryBackend(t *testing.T) {
+	first, firstCache := memoryBackend(t, "local:///first")
+	second, secondCache := memoryBackend(t, "local:///second")
+	readOnly, readOnlyCache := memoryBackend(t, "local:///read-only")
+	readOnly.write = false
+	broken := &backend{uri: "broken://", provider: brokenProvider{}, read: true, write: true}
+
+	// stored by another run already, so not uploaded again
+	present, presentCache := memoryBackend(t, "local:///present")
+	presentCache.PutEntry("key", bytes.NewBufferString("other run"))
+
+	// streamed like an archive, so it can only be read once
+	data := bytes.Repeat([]byte("result "), 100000)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(data)
+		pw.Close()
+	}()
+
+	cacheSave("key", []*backend{first, readOnly, broken, present, second}, pr, nil, false)
+
+	for _, local := range []*internal.LocalCache{firstCache, secondCache} {
+		if got := readEntry(t, local, "key"); !bytes.Equal(got, data) {
+			t.Errorf("%s has %d bytes that do not match the %d saved", local.URI, len(got), len(data))
+		}
+	}
+	if got := readEntry(t, presentCache, "key"); string(got) != "other run" {
+		t.Errorf("%s was overwritten", presentCache.URI)
+	}
+	assertEmpty(t, readOnlyCache, "/read-only")
+}
+
+func TestParseBackendMode(t *testing.T) {
+	tests := []struct {
+		uri       string
+		wantUri   string
+		wantRead  bool
+		wantWrite bool
+		wantErr   bool
+	}{
+		{"s3://bucket", "s3://bucket", true, true, false},
+		{"s3://bucket?mode=rw", "s3://bucket", true, true, false},
+		{"s3://bucket?mode=ro", "s3://bucket", true, false, false},
+		{"s3://bucket?mode=wo", "s3://bucket", false, true, false},
+		{"s3://bucket/prefix?mode=ro&endpoint=http://localhost:9000", "s3://bucket/prefix?endpoint=http%3A%2F%2Flocalhost%3A9000", true, false, false},
+		{"redis://localhost:6379/0?ttl=1h&mode=wo&chunk_size=1MiB", "redis://localhost:6379/0?chunk_size=1MiB&ttl=1h", false, true, false},
+		// without a query, URIs that are not valid URLs pass through
+		{`local://C:\ccmd cache`, `local://C:\ccmd cache`, true, true, false},
+
+		{"s3://bucket?mode=readonly", "", false, false, true},
+		{"s3://bucket?mode=", "", false, false, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.uri, func(t *testing.T) {
+			uri, read, write, err := parseBackendMode(tc.uri)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v; wantErr %v", err, tc.wantErr)
+			}
+			if uri != tc.wantUri || read != tc.wantRead || write != tc.wantWrite {
+				t.Errorf("got %q, read %v, write %v; want %q, read %v, write %v", uri, read, write, tc.wantUri, tc.wantRead, tc.wantWrite)
+			}
+		})
+	}
+}
+
+func TestBackendSpecs(t *testing.T) {
+	args := RunCommandArgs{
+		Cache:      []string{"local://.ccmd-cache", "s3://shared?mode=ro"},
+		CacheRead:  []string{"gs://team", "gs://readable?mode=rw", "gs://broken?mode=wo"},
+		CacheWrite: []string{"s3://populate", "s3://writable?mode=wo", "s3://broken?mode=ro"},
+	}
+
+	type access struct {
+		uri         string
+		read, write bool
+		err         bool
+	}
+	want := []access{
+		// --cache comes first, in the order given
+		{"local://.ccmd-cache", true, true, false},
+		{"s3://shared", true, false, false},
+		// then --cache-read, which ?mode cannot widen
+		{"gs://team", true, false, false},
+		{"gs://readable", true, false, false},
+		{"", false, false, true},
+		// then --cache-write
+		{"s3://populate", false, true, false},
+		{"s3://writable", false, true, false},
+		{"", false, false, true},
+	}
+
+	specs := backendSpecs(args)
+	if len(specs) != len(want) {
+		t.Fatalf("got %d specs; want %d", len(specs), len(want))
+	}
+
+	for i, spec := range specs {
+		uri, read, write, err := spec.access()
+		got := access{uri, read, write, err != nil}
+		if got != want[i] {
+			t.Errorf("%s: got %+v; want %+v", spec.uri, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package commands
+
+import (
+	"fmt"
+	nethttp "net/http"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/simse/ccmd/cache"
+	"github.com/simse/ccmd/cache/http"
+	"github.com/simse/ccmd/internal"
+)
+
+type ServeCmd struct {
+	Cache          string            `arg:"--cache" default:"local://.ccmd-cache"`
+	Listen         string            `arg:"--listen" default:":8080"`
+	Tokens         []string          `arg:"--token,env:CCMD_SERVE_TOKENS"`
+	ReadOnlyTokens []string          `arg:"--read-only-token,env:CCMD_SERVE_READ_ONLY_TOKENS"`
+	MaxEntrySize   internal.ByteSize `arg:"--max-entry-size"`
+	Quota          internal.ByteSize `arg:"--quota"`
+}
+
+func ServeCommand(args *ServeCmd, runtime RuntimeInformation) {
+	printLogo(runtime)
+
+	validateCacheBackends([]string{args.Cache})
+	provider, _ := cache.GetCacheProviderFromURI(args.Cache)
+
+	if args.Quota > 0 && !strings.HasPrefix(args.Cache, "local://") {
+		printError("--quota is only supported with a local:// cache", 1)
+	}
+
+	server := &http.Server{
+		Store:          provider,
+		Tokens:         args.Tokens,
+		ReadOnlyTokens: args.ReadOnlyTokens,
+		MaxEntrySize:   int64(args.MaxEntrySize),
+		MaxTotalSize:   int64(args.Quota),
+		Log:            func(format string, a ...any) { dimGrey.Printf(format, a...) },
+	}
+
+	fmt.Print("Serving cache: ")
+	color.Cyan(args.Cache)
+
+	fmt.Print("Listening on: ")
+	color.Cyan(args.Listen)
+
+	if len(args.Tokens) == 0 && len(args.ReadOnlyTokens) == 0 {
+		color.Yellow("Warning: no tokens given, anyone who can reach the server can read and write the cache")
+	}
+
+	fmt.Println()
+
+	// ReadTimeout is generous, as it covers uploading the largest entries
+	listener := &nethttp.Server{
+		Addr:              args.Listen,
+		Handler:           server,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       10 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	if err := listener.ListenAndServe(); err != nil {
+		printError(err.Error(), 1)
+	}
+}
@@ -0,0 +1,24 @@
+package internal
+
+// Access is what a backend's access check found out about one permission.
+type Access int
+
+const (
+	AccessDenied Access = iota
+	AccessAllowed
+
+	// AccessUnknown means the check could neither prove nor rule out the
+	// permission. It is treated as allowed.
+	AccessUnknown
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessAllowed:
+		return "ok"
+	case AccessUnknown:
+		return "unknown"
+	default:
+		return "denied"
+	}
+}
@@ -1,16 +1,27 @@
 package internal
 
 import (
+	"errors"
 	"io"
+	"io/fs"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/spf13/afero"
 )
 
+// partial uploads are written under this suffix and renamed once complete
+const tempSuffix = ".tmp"
+
+// entries can be read by other users of the machine, like files from Create
+const entryMode = 0644
+
 type LocalCache struct {
 	URI string
+	Dir string // parsed from URI if empty
 	FS  afero.Fs
 }
 
@@ -30,38 +41,105 @@ func (l *LocalCache) GetEntry(key string) (io.ReadCloser, error) {
 		return nil, err
 	}
 
+	// the modification time doubles as the last use, for Evict
+	now := time.Now()
+	l.FS.Chtimes(l.getEntryPath(key), now, now)
+
 	return file, nil
 }
 
+// Has checks for an entry without counting it as a use.
+func (l *LocalCache) Has(key string) (bool, error) {
+	_, err := l.FS.Stat(l.getEntryPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 func (l *LocalCache) PutEntry(key string, body io.Reader) (int64, error) {
 	// ensure directory exists
 	l.createCacheDir()
 
-	// open file
-	file, err := l.FS.Create(l.getEntryPath(key))
+	// open file, readers never see a partial entry
+	file, err := afero.TempFile(l.FS, l.getCacheDir(), key+".*"+tempSuffix)
 
 	if err != nil {
 		return 0, err
 	}
+	tempPath := file.Name()
 
 	// write to file
 	bytesWritten, err := io.Copy(file, body)
+	file.Close()
 
 	if err != nil {
+		l.FS.Remove(tempPath)
 		return 0, err
 	}
 
-	file.Close()
+	// temp files are private, but the cache directory may be shared
+	if err := l.FS.Chmod(tempPath, entryMode); err != nil {
+		l.FS.Remove(tempPath)
+		return 0, err
+	}
+
+	if err := l.FS.Rename(tempPath, l.getEntryPath(key)); err != nil {
+		l.FS.Remove(tempPath)
+		return 0, err
+	}
 
 	return bytesWritten, nil
 }
 
+// Evict removes the least recently used entries until the cache takes up at
+// most maxBytes, and returns the keys of the removed entries.
+func (l *LocalCache) Evict(maxBytes int64) ([]string, error) {
+	files, err := afero.ReadDir(l.FS, l.getCacheDir())
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	var entries []fs.FileInfo
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), tempSuffix) {
+			continue
+		}
+		total += f.Size()
+		entries = append(entries, f)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	var evicted []string
+	for _, entry := range entries {
+		if total <= maxBytes {
+			break
+		}
+
+		if err := l.FS.Remove(l.getEntryPath(entry.Name())); err != nil {
+			return evicted, err
+		}
+
+		total -= entry.Size()
+		evicted = append(evicted, entry.Name())
+	}
+
+	return evicted, nil
+}
+
 func (l *LocalCache) GetFriendlyName() string {
 	return "local folder"
 }
 
 func (l *LocalCache) getCacheDir() string {
-	dir := strings.Replace(l.URI, "local://", "", 1)
+	dir := l.Dir
+	if dir == "" {
+		dir = strings.Replace(l.URI, "local://", "", 1)
+	}
 
 	dirAbsolute, _ := filepath.Abs(dir)
 
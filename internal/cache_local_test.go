@@ -3,7 +3,9 @@ package internal_test
 import (
 	"bytes"
 	"io"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/simse/ccmd/internal"
 	"github.com/spf13/afero"
@@ -27,6 +29,16 @@ func TestPutEntryAndGetEntry(t *testing.T) {
 		t.Errorf("PutEntry wrote %d bytes; want %d", n, len(data))
 	}
 
+	// Entries are readable by everyone, not only the owner like temp files
+	dir, _ := filepath.Abs("testdir")
+	info, err := fs.Stat(filepath.Join(dir, "foo.txt"))
+	if err != nil {
+		t.Fatalf("Stat returned unexpected error: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0644 {
+		t.Errorf("entry mode = %v; want -rw-r--r--", mode)
+	}
+
 	// Test GetEntry retrieves the same data
 	rc, err := cache.GetEntry("foo.txt")
 	if err != nil {
@@ -56,6 +68,26 @@ func TestGetEntryNotExist(t *testing.T) {
 	}
 }
 
+func TestHas(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cache := &internal.LocalCache{
+		URI: "local://testdir",
+		FS:  fs,
+	}
+
+	if ok, err := cache.Has("foo.txt"); err != nil || ok {
+		t.Errorf("Has before PutEntry = %v, %v; want false", ok, err)
+	}
+
+	if _, err := cache.PutEntry("foo.txt", bytes.NewBufferString("hello")); err != nil {
+		t.Fatalf("PutEntry returned unexpected error: %v", err)
+	}
+
+	if ok, err := cache.Has("foo.txt"); err != nil || !ok {
+		t.Errorf("Has after PutEntry = %v, %v; want true", ok, err)
+	}
+}
+
 func TestGetFriendlyName(t *testing.T) {
 	cache := &internal.LocalCache{}
 	want := "local folder"
@@ -76,3 +108,43 @@ func TestPutEntryCreateError(t *testing.T) {
 		t.Error("PutEntry expected error when create fails; got nil")
 	}
 }
+
+func TestEvict(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cache := &internal.LocalCache{
+		URI: "local:///testdir",
+		FS:  fs,
+	}
+
+	for _, key := range []string{"old", "used", "new"} {
+		if _, err := cache.PutEntry(key, bytes.NewBufferString("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// make the modification times distinct, then read "used" to mark it as
+	// recently used
+	base := time.Now().Add(-time.Hour)
+	for i, key := range []string{"old", "used", "new"} {
+		at := base.Add(time.Duration(i) * time.Minute)
+		fs.Chtimes("/testdir/"+key, at, at)
+	}
+	if rc, err := cache.GetEntry("used"); err == nil {
+		rc.Close()
+	}
+
+	evicted, err := cache.Evict(10)
+	if err != nil {
+		t.Fatalf("Evict returned error: %v", err)
+	}
+	if len(evicted) != 1 || evicted[0] != "old" {
+		t.Errorf("evicted = %v; want [old]", evicted)
+	}
+
+	for key, want := range map[string]bool{"old": false, "used": true, "new": true} {
+		_, err := cache.GetEntry(key)
+		if (err == nil) != want {
+			t.Errorf("entry %q present = %v; want %v", key, err == nil, want)
+		}
+	}
+}
@@ -2,62 +2,328 @@ package internal
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/fatih/color"
 )
 
-var dimGrey = color.RGB(160, 160, 160).PrintlnFunc()
+var dimGrey = color.RGB(160, 160, 160)
 
-// RunCommand streams a command’s output, printing each stdout line to stdout
-// and each stderr line to stderr. It returns an error if the command fails to start
-// or exits with a non-zero status.
-func RunCommand(command string, workingDirectory string) error {
-	parts := strings.Fields(command)
-	if len(parts) == 0 {
+type CommandOptions struct {
+	WorkingDirectory string
+
+	// Env is added to the environment inherited from ccmd. With Hermetic, it
+	// is the entire environment of the command.
+	Env      []string
+	Hermetic bool
+
+	// Log receives a copy of every line the command writes to stdout and stderr.
+	Log io.Writer
+
+	// Stdout, if set, receives the command's stdout byte for byte instead of
+	// the terminal and Log. It cannot be combined with TTY.
+	Stdout io.Writer
+
+	// Timeout stops the command once it has run for this long, asking it to
+	// terminate first and killing it if it is still running after KillAfter.
+	Timeout   time.Duration
+	KillAfter time.Duration
+
+	// TTY runs the command under a pseudo-terminal so it keeps colours and
+	// progress output. Its output is forwarded and logged byte for byte.
+	TTY bool
+
+	// TraceReads, if set, is called with the absolute path of every file the
+	// command's process tree opens for reading. Only supported on Linux.
+	TraceReads func(path string)
+}
+
+// CommandError is returned when a command was started but did not succeed.
+type CommandError struct {
+	ExitCode int
+
+	// Signal is set if the command was terminated by a signal.
+	Signal syscall.Signal
+
+	// Interrupted is set if ccmd forwarded a signal it received to the command.
+	Interrupted bool
+
+	// TimedOut is set if the command was stopped after running for Timeout.
+	TimedOut bool
+	Timeout  time.Duration
+}
+
+func (e *CommandError) Error() string {
+	switch {
+	case e.TimedOut:
+		return fmt.Sprintf("command timed out after %s", e.Timeout)
+	case e.Signal != 0:
+		return fmt.Sprintf("command was terminated by signal: %s", e.Signal)
+	case e.Interrupted && e.ExitCode == 0:
+		return "command was interrupted"
+	default:
+		return fmt.Sprintf("command exited with code %d", e.ExitCode)
+	}
+}
+
+// RunCommand streams a command’s output line by line, or raw with TTY. It
+// returns an error if the command fails to start or does not succeed, in which
+// case the error is a *CommandError.
+//
+// The command runs in its own process group. Interrupts received by ccmd are
+// forwarded to the whole group rather than leaving orphans behind.
+func RunCommand(argv []string, opts CommandOptions) error {
+	if len(argv) == 0 {
 		return fmt.Errorf("no command provided")
 	}
 
-	cmd := exec.Command(parts[0], parts[1:]...)
-	cmd.Dir = workingDirectory
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Dir = opts.WorkingDirectory
+	if opts.Hermetic {
+		cmd.Env = append([]string{}, opts.Env...)
+	} else {
+		cmd.Env = append(os.Environ(), opts.Env...)
+	}
 
-	// get pipes
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("StdoutPipe: %w", err)
+	log := &lockedWriter{w: opts.Log}
+	if opts.Log == nil {
+		log.w = io.Discard
 	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("StderrPipe: %w", err)
+
+	// catch signals before starting, so none of them kill ccmd alone
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	var (
+		wg             sync.WaitGroup
+		terminal       *os.File
+		stdout, stderr io.ReadCloser
+		err            error
+	)
+
+	start := cmd.Start
+
+	if opts.TTY {
+		// stdout and stderr share the terminal
+		start = func() (err error) {
+			terminal, err = startTerminal(cmd)
+			return err
+		}
+	} else {
+		setProcessGroup(cmd)
+
+		// get pipes
+		if opts.Stdout != nil {
+			cmd.Stdout = opts.Stdout
+		} else {
+			stdout, err = cmd.StdoutPipe()
+			if err != nil {
+				return fmt.Errorf("StdoutPipe: %w", err)
+			}
+		}
+		stderr, err = cmd.StderrPipe()
+		if err != nil {
+			return fmt.Errorf("StderrPipe: %w", err)
+		}
 	}
 
 	// start the process
-	if err := cmd.Start(); err != nil {
+	var tracer *fileTracer
+	if opts.TraceReads != nil {
+		tracer, err = startTraced(cmd, start, opts.TraceReads)
+	} else {
+		err = start()
+	}
+
+	if err != nil {
 		return fmt.Errorf("cmd.Start: %w", err)
 	}
 
-	// scan stdout
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			dimGrey(scanner.Text())
-		}
-	}()
+	if opts.TTY {
+		defer terminal.Close()
 
-	// scan stderr
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			dimGrey(os.Stderr, scanner.Text())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forwardRaw(terminal, os.Stdout, log)
+		}()
+	} else {
+		if stdout != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				forwardLines(stdout, os.Stdout, log)
+			}()
 		}
-	}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forwardLines(stderr, os.Stderr, log)
+		}()
+	}
+
+	var interrupted, timedOut atomic.Bool
+	done := make(chan struct{})
+	defer close(done)
+
+	go superviseCommand(cmd, opts, signals, done, &interrupted, &timedOut)
+
+	// pipes must be drained before Wait closes them
+	wg.Wait()
 
 	// wait for it to finish
-	if err := cmd.Wait(); err != nil {
+	exitCode, sig, err := waitCommand(cmd, tracer)
+	if err != nil {
 		return fmt.Errorf("cmd.Wait: %w", err)
 	}
-	return nil
+
+	// a command that handles the forwarded signal may exit cleanly without
+	// having finished its work
+	if exitCode == 0 && !timedOut.Load() && !interrupted.Load() {
+		return nil
+	}
+
+	cmdErr := &CommandError{
+		ExitCode:    exitCode,
+		Signal:      sig,
+		Interrupted: interrupted.Load(),
+		TimedOut:    timedOut.Load(),
+		Timeout:     opts.Timeout,
+	}
+
+	if cmdErr.TimedOut {
+		// same convention as coreutils timeout
+		cmdErr.ExitCode = 124
+	}
+
+	return cmdErr
+}
+
+// waitCommand waits for the command to exit and returns its exit code. If it
+// was terminated by a signal, the code is 128 plus the signal number.
+func waitCommand(cmd *exec.Cmd, tracer *fileTracer) (int, syscall.Signal, error) {
+	if tracer != nil {
+		exitCode, sig, err := tracer.wait()
+
+		// the tracer has reaped the process already, Wait only releases the
+		// resources held by cmd
+		cmd.Wait()
+
+		return exitCode, sig, err
+	}
+
+	err := cmd.Wait()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0, 0, nil
+	case !errors.As(err, &exitErr):
+		return 0, 0, err
+	case exitErr.ExitCode() >= 0:
+		return exitErr.ExitCode(), 0, nil
+	}
+
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), status.Signal(), nil
+	}
+
+	return 1, 0, nil
+}
+
+// superviseCommand forwards signals to the command's process group and
+// enforces the timeout until done is closed.
+func superviseCommand(cmd *exec.Cmd, opts CommandOptions, signals <-chan os.Signal, done <-chan struct{}, interrupted, timedOut *atomic.Bool) {
+	var timeout, kill <-chan time.Time
+
+	if opts.Timeout > 0 {
+		timer := time.NewTimer(opts.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case sig := <-signals:
+			interrupted.Store(true)
+			signalProcessGroup(cmd, sig)
+
+		case <-timeout:
+			timedOut.Store(true)
+			timeout = nil
+			signalProcessGroup(cmd, terminateSignal)
+
+			timer := time.NewTimer(opts.KillAfter)
+			defer timer.Stop()
+			kill = timer.C
+
+		case <-kill:
+			kill = nil
+			signalProcessGroup(cmd, os.Kill)
+		}
+	}
+}
+
+// forwardLines copies r line by line to w and log. Unlike bufio.Scanner it
+// has no limit on the length of a line.
+func forwardLines(r io.Reader, w io.Writer, log io.Writer) {
+	reader := bufio.NewReader(r)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			line = strings.TrimSuffix(line, "\n")
+			dimGrey.Fprintln(w, line)
+			fmt.Fprintln(log, line)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// forwardRaw copies a terminal's output as-is, escape codes included.
+func forwardRaw(r io.Reader, w io.Writer, log io.Writer) {
+	// reading the terminal fails with EIO once the command exits, which is
+	// how the copy ends
+	io.Copy(io.MultiWriter(w, log), r)
+}
+
+// ExitCode returns the exit status of a command that failed with err, or 1 if
+// the command could not be run at all.
+func ExitCode(err error) int {
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) && cmdErr.ExitCode > 0 {
+		return cmdErr.ExitCode
+	}
+
+	return 1
+}
+
+// lockedWriter serialises writes from the stdout and stderr goroutines.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
 }
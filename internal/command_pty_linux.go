@@ -0,0 +1,26 @@
+//go:build linux
+
+package internal
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+)
+
+// startTerminal starts cmd with a new pseudo-terminal as its stdin, stdout and
+// stderr, and returns the controlling side of it.
+func startTerminal(cmd *exec.Cmd) (*os.File, error) {
+	// pty.Start makes the command a session leader, which also gives it its
+	// own process group for signalProcessGroup
+	terminal, err := pty.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// best effort, ccmd itself may not be attached to a terminal
+	_ = pty.InheritSize(os.Stdout, terminal)
+
+	return terminal, nil
+}
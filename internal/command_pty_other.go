@@ -0,0 +1,13 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+func startTerminal(cmd *exec.Cmd) (*os.File, error) {
+	return nil, errors.New("running commands under a pseudo-terminal is only supported on Linux")
+}
@@ -0,0 +1,338 @@
+//go:build !windows
+
+package internal_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/simse/ccmd/internal"
+)
+
+// helper to write a shell script into a temp dir and return its argv
+func writeScript(t *testing.T, dir string, body string) []string {
+	t.Helper()
+	path := filepath.Join(dir, "script.sh")
+	if err := os.WriteFile(path, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return []string{"/bin/sh", path}
+}
+
+// syncBuffer lets the test poll the log while the command is still writing it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+// waitFor polls cond until it is true or the deadline passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunCommandSuccess(t *testing.T) {
+	dir := t.TempDir()
+	var log bytes.Buffer
+
+	err := internal.RunCommand(writeScript(t, dir, "echo out; echo err >&2"), internal.CommandOptions{
+		WorkingDirectory: dir,
+		Log:              &log,
+	})
+	if err != nil {
+		t.Fatalf("RunCommand returned error: %v", err)
+	}
+	if !strings.Contains(log.String(), "out\n") || !strings.Contains(log.String(), "err\n") {
+		t.Errorf("log = %q; want both stdout and stderr", log.String())
+	}
+}
+
+func TestRunCommandLongLines(t *testing.T) {
+	dir := t.TempDir()
+	var log bytes.Buffer
+
+	// well past bufio.Scanner's 64KiB token limit
+	long := strings.Repeat("x", 200*1024)
+	err := internal.RunCommand(writeScript(t, dir, "printf '%s\\nafter\\nno newline' "+long), internal.CommandOptions{
+		WorkingDirectory: dir,
+		Log:              &log,
+	})
+	if err != nil {
+		t.Fatalf("RunCommand returned error: %v", err)
+	}
+
+	want := long + "\nafter\nno newline\n"
+	if log.String() != want {
+		t.Errorf("log has %d bytes; want %d", log.Len(), len(want))
+	}
+}
+
+func TestRunCommandTTY(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("pseudo-terminals are only supported on Linux")
+	}
+
+	dir := t.TempDir()
+	var log bytes.Buffer
+
+	err := internal.RunCommand(writeScript(t, dir, `if [ -t 1 ] && [ -t 2 ]; then printf 'is a tty\033[0m\n'; fi`), internal.CommandOptions{
+		WorkingDirectory: dir,
+		Log:              &log,
+		TTY:              true,
+	})
+	if err != nil {
+		t.Fatalf("RunCommand returned error: %v", err)
+	}
+
+	// raw bytes, including the escape code and the terminal's line ending
+	if log.String() != "is a tty\x1b[0m\r\n" {
+		t.Errorf("log = %q", log.String())
+	}
+}
+
+func TestRunCommandExitCode(t *testing.T) {
+	dir := t.TempDir()
+
+	err := internal.RunCommand(writeScript(t, dir, "exit 7"), internal.CommandOptions{WorkingDirectory: dir})
+
+	var cmdErr *internal.CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("err = %v; want *CommandError", err)
+	}
+	if cmdErr.ExitCode != 7 || internal.ExitCode(err) != 7 {
+		t.Errorf("exit code = %d; want 7", cmdErr.ExitCode)
+	}
+	if err.Error() != "command exited with code 7" {
+		t.Errorf("err = %q", err.Error())
+	}
+}
+
+func TestRunCommandStartError(t *testing.T) {
+	err := internal.RunCommand([]string{"ccmd-test-no-such-binary"}, internal.CommandOptions{})
+	if err == nil {
+		t.Fatal("expected an error for a missing binary")
+	}
+	if errors.As(err, new(*internal.CommandError)) {
+		t.Errorf("start failure should not be a CommandError: %v", err)
+	}
+	if internal.ExitCode(err) != 1 {
+		t.Errorf("ExitCode = %d; want 1", internal.ExitCode(err))
+	}
+}
+
+func TestRunCommandTimeoutGraceful(t *testing.T) {
+	dir := t.TempDir()
+	var log syncBuffer
+
+	start := time.Now()
+	err := internal.RunCommand(writeScript(t, dir, `trap 'echo terminating; exit 0' TERM
+sleep 30 &
+wait`), internal.CommandOptions{
+		WorkingDirectory: dir,
+		Log:              &log,
+		Timeout:          200 * time.Millisecond,
+		KillAfter:        10 * time.Second,
+	})
+
+	var cmdErr *internal.CommandError
+	if !errors.As(err, &cmdErr) || !cmdErr.TimedOut {
+		t.Fatalf("err = %v; want a timeout", err)
+	}
+	if cmdErr.ExitCode != 124 {
+		t.Errorf("exit code = %d; want 124", cmdErr.ExitCode)
+	}
+	if !strings.Contains(log.String(), "terminating") {
+		t.Errorf("command did not get a chance to shut down, log = %q", log.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command took %s to stop; it should not have waited for the kill", elapsed)
+	}
+}
+
+func TestRunCommandTimeoutKill(t *testing.T) {
+	dir := t.TempDir()
+
+	start := time.Now()
+	err := internal.RunCommand(writeScript(t, dir, `trap '' TERM
+sleep 30`), internal.CommandOptions{
+		WorkingDirectory: dir,
+		Timeout:          100 * time.Millisecond,
+		KillAfter:        200 * time.Millisecond,
+	})
+
+	var cmdErr *internal.CommandError
+	if !errors.As(err, &cmdErr) || !cmdErr.TimedOut {
+		t.Fatalf("err = %v; want a timeout", err)
+	}
+	if err.Error() != "command timed out after 100ms" {
+		t.Errorf("err = %q", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command ignoring SIGTERM was not killed, took %s", elapsed)
+	}
+}
+
+func TestRunCommandForwardsSignalsToProcessGroup(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "grandchild-terminated")
+	var log syncBuffer
+
+	// the grandchild proves that the whole group is signalled, not just the
+	// direct child
+	argv := writeScript(t, dir, `sh -c 'trap "touch grandchild-terminated; exit 0" TERM; sleep 30 & wait' &
+echo ready
+wait`)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- internal.RunCommand(argv, internal.CommandOptions{WorkingDirectory: dir, Log: &log})
+	}()
+
+	waitFor(t, "command to start", func() bool { return strings.Contains(log.String(), "ready") })
+
+	// ccmd receives SIGTERM, as it would when a CI job is cancelled
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command did not stop after SIGTERM was forwarded")
+	}
+
+	var cmdErr *internal.CommandError
+	if !errors.As(err, &cmdErr) || !cmdErr.Interrupted {
+		t.Fatalf("err = %v; want an interrupted command", err)
+	}
+	if cmdErr.Signal != syscall.SIGTERM || cmdErr.ExitCode != 128+int(syscall.SIGTERM) {
+		t.Errorf("signal = %v, exit code = %d; want SIGTERM and %d", cmdErr.Signal, cmdErr.ExitCode, 128+int(syscall.SIGTERM))
+	}
+
+	waitFor(t, "grandchild to receive SIGTERM", func() bool {
+		_, err := os.Stat(marker)
+		return err == nil
+	})
+}
+
+func TestRunCommandInterruptedExitZero(t *testing.T) {
+	dir := t.TempDir()
+	var log syncBuffer
+
+	argv := writeScript(t, dir, `trap 'exit 0' TERM
+echo ready
+sleep 30 &
+wait`)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- internal.RunCommand(argv, internal.CommandOptions{WorkingDirectory: dir, Log: &log})
+	}()
+
+	waitFor(t, "command to start", func() bool { return strings.Contains(log.String(), "ready") })
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(5 * time.Second):
+		t.Fatal("command did not stop after SIGTERM was forwarded")
+	}
+
+	// exiting 0 after an interrupt must not count as success, or the partial
+	// outputs would be cached
+	var cmdErr *internal.CommandError
+	if !errors.As(err, &cmdErr) || !cmdErr.Interrupted {
+		t.Fatalf("err = %v; want an interrupted command", err)
+	}
+	if err.Error() != "command was interrupted" || internal.ExitCode(err) != 1 {
+		t.Errorf("err = %q, exit code = %d", err.Error(), internal.ExitCode(err))
+	}
+}
+
+func TestRunCommandEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CCMD_TEST_INHERITED", "inherited")
+	var log bytes.Buffer
+
+	err := internal.RunCommand(writeScript(t, dir, `echo "$CCMD_TEST_INHERITED $CCMD_CACHE_KEY"`), internal.CommandOptions{
+		WorkingDirectory: dir,
+		Env:              []string{"CCMD_CACHE_KEY=abc123"},
+		Log:              &log,
+	})
+	if err != nil {
+		t.Fatalf("RunCommand returned error: %v", err)
+	}
+	if log.String() != "inherited abc123\n" {
+		t.Errorf("log = %q", log.String())
+	}
+}
+
+func TestRunCommandHermeticEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CCMD_TEST_UNDECLARED", "leaked")
+	var log bytes.Buffer
+
+	err := internal.RunCommand(writeScript(t, dir, `echo "[$CCMD_TEST_UNDECLARED] [$DECLARED]"`), internal.CommandOptions{
+		WorkingDirectory: dir,
+		Env:              []string{"DECLARED=yes"},
+		Hermetic:         true,
+		Log:              &log,
+	})
+	if err != nil {
+		t.Fatalf("RunCommand returned error: %v", err)
+	}
+	if log.String() != "[] [yes]\n" {
+		t.Errorf("log = %q", log.String())
+	}
+}
+
+func TestRunCommandStdout(t *testing.T) {
+	dir := t.TempDir()
+	var stdout, log bytes.Buffer
+
+	err := internal.RunCommand(writeScript(t, dir, `printf 'binary\000data'; echo progress >&2`), internal.CommandOptions{
+		WorkingDirectory: dir,
+		Stdout:           &stdout,
+		Log:              &log,
+	})
+	if err != nil {
+		t.Fatalf("RunCommand returned error: %v", err)
+	}
+	if stdout.String() != "binary\x00data" {
+		t.Errorf("stdout = %q", stdout.String())
+	}
+	if log.String() != "progress\n" {
+		t.Errorf("log = %q; want only stderr", log.String())
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package internal
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+var forwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+var terminateSignal os.Signal = syscall.SIGTERM
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	// a negative pid addresses the whole process group
+	return syscall.Kill(-cmd.Process.Pid, sig.(syscall.Signal))
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package internal
+
+import (
+	"os"
+	"os/exec"
+)
+
+var forwardedSignals = []os.Signal{os.Interrupt}
+
+var terminateSignal = os.Kill
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	// the console already delivers Ctrl-C to the command, anything else can
+	// only kill it
+	if sig == os.Interrupt {
+		return nil
+	}
+
+	return cmd.Process.Kill()
+}
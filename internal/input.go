@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -125,3 +126,155 @@ func HashDir(fs afero.Fs, paths []string, fingerprint string) (string, error) {
 	// Return hex string
 	return fmt.Sprintf("%016x", rawHash), nil
 }
+
+// UndeclaredInputs returns the files in reads that are inside rootDir but
+// were not found as inputs, relative to rootDir. Files matching
+// ignorePatterns, directories and anything in node_modules are left out, the
+// same as in FindFiles.
+func UndeclaredInputs(reads []string, inputs []string, ignorePatterns []string, rootDir string) ([]string, error) {
+	absRoot, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	declared := make(map[string]struct{}, len(inputs))
+	for _, input := range inputs {
+		if rel, err := filepath.Rel(absRoot, input); err == nil {
+			declared[rel] = struct{}{}
+		}
+	}
+
+	// traced paths have their symlinks resolved
+	realRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	var undeclared []string
+
+	for _, read := range reads {
+		rel, err := filepath.Rel(realRoot, read)
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+
+		if _, ok := declared[rel]; ok {
+			continue
+		}
+		if _, ok := seen[rel]; ok {
+			continue
+		}
+		seen[rel] = struct{}{}
+
+		if ignoredPath(rel, ignorePatterns) {
+			continue
+		}
+
+		if info, err := os.Stat(read); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		undeclared = append(undeclared, rel)
+	}
+
+	sort.Strings(undeclared)
+	return undeclared, nil
+}
+
+func ignoredPath(rel string, ignorePatterns []string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if part == "node_modules" {
+			return true
+		}
+	}
+
+	return MatchesAny(rel, ignorePatterns)
+}
+
+// QuotePattern escapes the glob metacharacters in path, so that it is matched
+// literally.
+func QuotePattern(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`\*?[]{}`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// MatchesAny reports whether the relative path matches any of patterns.
+func MatchesAny(rel string, patterns []string) bool {
+	for _, pat := range patterns {
+		if ok, _ := doublestar.Match(pat, filepath.ToSlash(rel)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Unmatched returns the relative paths that match none of patterns.
+func Unmatched(paths []string, patterns []string) []string {
+	var unmatched []string
+	for _, path := range paths {
+		if !MatchesAny(path, patterns) {
+			unmatched = append(unmatched, path)
+		}
+	}
+	return unmatched
+}
+
+// LookupEnv returns NAME=value for each of names that is set in the
+// environment, sorted and without duplicates.
+func LookupEnv(names []string) []string {
+	seen := make(map[string]struct{})
+	var pairs []string
+
+	for _, name := range names {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		if value, ok := os.LookupEnv(name); ok {
+			pairs = append(pairs, name+"="+value)
+		}
+	}
+
+	sort.Strings(pairs)
+	return pairs
+}
+
+// EnvFingerprint folds environment pairs into a HashDir fingerprint. It is
+// empty for no pairs, so keys without declared variables do not change.
+func EnvFingerprint(pairs []string) string {
+	var b strings.Builder
+	for _, pair := range pairs {
+		b.WriteString("\x00env:")
+		b.WriteString(pair)
+	}
+	return b.String()
+}
+
+// WriteFileList writes paths to a new temporary file, one per line, and
+// returns its name. The caller is responsible for removing it.
+func WriteFileList(paths []string) (string, error) {
+	f, err := os.CreateTemp("", "ccmd-inputs-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	for _, path := range paths {
+		if _, err := fmt.Fprintln(f, path); err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+
+	return f.Name(), nil
+}
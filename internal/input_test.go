@@ -222,3 +222,86 @@ func FuzzHashDir(f *testing.F) {
 		}
 	})
 }
+
+func TestWriteFileList(t *testing.T) {
+	paths := []string{"/repo/a.go", "/repo/sub dir/b.go"}
+
+	name, err := internal.WriteFileList(paths)
+	if err != nil {
+		t.Fatalf("WriteFileList returned error: %v", err)
+	}
+	defer os.Remove(name)
+
+	content, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/repo/a.go\n/repo/sub dir/b.go\n"; string(content) != want {
+		t.Errorf("file list = %q; want %q", content, want)
+	}
+}
+
+func TestLookupEnv(t *testing.T) {
+	t.Setenv("CCMD_TEST_B", "2")
+	t.Setenv("CCMD_TEST_A", "1")
+	t.Setenv("CCMD_TEST_EMPTY", "")
+
+	got := internal.LookupEnv([]string{"CCMD_TEST_B", "CCMD_TEST_UNSET", "CCMD_TEST_A", "CCMD_TEST_B", "CCMD_TEST_EMPTY"})
+	want := []string{"CCMD_TEST_A=1", "CCMD_TEST_B=2", "CCMD_TEST_EMPTY="}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LookupEnv = %q; want %q", got, want)
+	}
+}
+
+func TestEnvFingerprint(t *testing.T) {
+	if fp := internal.EnvFingerprint(nil); fp != "" {
+		t.Errorf("EnvFingerprint(nil) = %q; want empty so existing keys are unchanged", fp)
+	}
+
+	a := internal.EnvFingerprint([]string{"GOOS=linux"})
+	b := internal.EnvFingerprint([]string{"GOOS=darwin"})
+	if a == b {
+		t.Errorf("different values produced the same fingerprint %q", a)
+	}
+}
+
+func TestUndeclaredInputs(t *testing.T) {
+	root := t.TempDir()
+	createTree(t, root, []string{
+		"src/a.ts", "src/b.ts", "tsconfig.json", "dist/out.js",
+		"node_modules/pkg/index.js", "dir/",
+	})
+	abs := func(rel string) string { return filepath.Join(root, rel) }
+
+	reads := []string{
+		abs("src/a.ts"),
+		abs("tsconfig.json"),
+		abs("tsconfig.json"),
+		abs("dist/out.js"),
+		abs("node_modules/pkg/index.js"),
+		abs("dir"),
+		abs("deleted.txt"),
+		"/etc/hosts",
+	}
+	inputs := []string{abs("src/a.ts"), abs("src/b.ts")}
+
+	got, err := internal.UndeclaredInputs(reads, inputs, []string{"dist/**"}, root)
+	if err != nil {
+		t.Fatalf("UndeclaredInputs returned error: %v", err)
+	}
+	if want := []string{"tsconfig.json"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("UndeclaredInputs = %v; want %v", got, want)
+	}
+}
+
+func TestQuotePattern(t *testing.T) {
+	for _, path := range []string{"out.txt", "out[1].txt", "gen/*?.pb", "{a,b}.json", `back\slash`} {
+		if !internal.MatchesAny(path, []string{internal.QuotePattern(path)}) {
+			t.Errorf("QuotePattern(%q) = %q does not match the path", path, internal.QuotePattern(path))
+		}
+	}
+
+	if internal.MatchesAny("out1.txt", []string{internal.QuotePattern("out[1].txt")}) {
+		t.Error("quoted pattern should not match as a character class")
+	}
+}
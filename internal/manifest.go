@@ -0,0 +1,31 @@
+package internal
+
+import "time"
+
+// Archive members under MetadataDir describe the cache entry itself and are
+// never extracted into the working directory.
+const (
+	MetadataDir  = ".ccmd/"
+	ManifestPath = MetadataDir + "manifest.json"
+	LogPath      = MetadataDir + "output.log"
+)
+
+// Manifest is stored alongside the output files of a cache entry.
+type Manifest struct {
+	Version   string    `json:"version"`
+	Command   string    `json:"command"`
+	ExitCode  int       `json:"exit_code"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Outputs lists the files captured when no output patterns were given.
+	Outputs []string `json:"outputs,omitempty"`
+
+	// Log is the combined output of the command, stored as its own member.
+	Log []byte `json:"-"`
+}
+
+// Expired reports whether the entry has a TTL that has passed at now.
+func (m *Manifest) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && now.After(m.ExpiresAt)
+}
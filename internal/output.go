@@ -2,17 +2,23 @@ package internal
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"encoding/json"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-func CaptureOutput(paths []string, key string, cwd string) (io.Reader, error) {
-	return CreateArchive(paths, cwd)
+func CaptureOutput(paths []string, manifest *Manifest, cwd string) (io.Reader, error) {
+	return CreateArchive(paths, manifest, cwd)
 }
 
-func CreateArchive(paths []string, cwd string) (io.Reader, error) {
+// CreateArchive streams a .tar.gz of paths, relative to cwd. If manifest is
+// not nil it is written first, followed by the command log.
+func CreateArchive(paths []string, manifest *Manifest, cwd string) (io.Reader, error) {
 	pr, pw := io.Pipe()
 
 	go func() {
@@ -31,6 +37,13 @@ func CreateArchive(paths []string, cwd string) (io.Reader, error) {
 			return
 		}
 
+		if manifest != nil {
+			if err := writeManifest(tw, manifest); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+
 		for _, src := range paths {
 			err := filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
 				if err != nil {
@@ -78,9 +91,40 @@ func CreateArchive(paths []string, cwd string) (io.Reader, error) {
 	return pr, nil
 }
 
+func writeManifest(tw *tar.Writer, manifest *Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := writeMember(tw, ManifestPath, data); err != nil {
+		return err
+	}
+
+	return writeMember(tw, LogPath, manifest.Log)
+}
+
+func writeMember(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(data)
+	return err
+}
+
 // ExtractArchive takes a .tar.gz archive at srcPath and extracts its
-// contents into destDir, recreating the original file structure.
-func ExtractArchive(cacheBody io.Reader, destDir string) ([]string, error) {
+// contents into destDir, recreating the original file structure. The
+// manifest is returned if the archive has one, otherwise it is nil.
+func ExtractArchive(cacheBody io.Reader, destDir string) ([]string, *Manifest, error) {
 	// srcPath := getEntryPath(key)
 
 	// Open the archive for reading
@@ -93,7 +137,7 @@ func ExtractArchive(cacheBody io.Reader, destDir string) ([]string, error) {
 	// Set up gzip reader
 	gzReader, err := gzip.NewReader(cacheBody)
 	if err != nil {
-		return []string{}, err
+		return []string{}, nil, err
 	}
 	defer gzReader.Close()
 
@@ -101,6 +145,7 @@ func ExtractArchive(cacheBody io.Reader, destDir string) ([]string, error) {
 	tarReader := tar.NewReader(gzReader)
 
 	writtenFiles := []string{}
+	var manifest *Manifest
 
 	// Iterate through entries
 	for {
@@ -109,7 +154,29 @@ func ExtractArchive(cacheBody io.Reader, destDir string) ([]string, error) {
 			break // End of archive
 		}
 		if err != nil {
-			return writtenFiles, err
+			return writtenFiles, manifest, err
+		}
+
+		// entry metadata is kept out of the working directory
+		if strings.HasPrefix(hdr.Name, MetadataDir) {
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, tarReader); err != nil {
+				return writtenFiles, manifest, err
+			}
+
+			if manifest == nil {
+				manifest = &Manifest{}
+			}
+
+			switch hdr.Name {
+			case ManifestPath:
+				if err := json.Unmarshal(buf.Bytes(), manifest); err != nil {
+					return writtenFiles, manifest, err
+				}
+			case LogPath:
+				manifest.Log = buf.Bytes()
+			}
+			continue
 		}
 
 		targetPath := filepath.Join(destDir, hdr.Name)
@@ -118,25 +185,25 @@ func ExtractArchive(cacheBody io.Reader, destDir string) ([]string, error) {
 		case tar.TypeDir:
 			// Create directory
 			if err := os.MkdirAll(targetPath, os.FileMode(hdr.Mode)); err != nil {
-				return writtenFiles, err
+				return writtenFiles, manifest, err
 			}
 
 		case tar.TypeReg:
 			// Ensure parent directory exists
 			if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-				return writtenFiles, err
+				return writtenFiles, manifest, err
 			}
 
 			// Create file
 			outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR, os.FileMode(hdr.Mode))
 			if err != nil {
-				return writtenFiles, err
+				return writtenFiles, manifest, err
 			}
 			defer outFile.Close()
 
 			// Copy file contents
 			if _, err := io.Copy(outFile, tarReader); err != nil {
-				return writtenFiles, err
+				return writtenFiles, manifest, err
 			}
 
 			writtenFiles = append(writtenFiles, outFile.Name())
@@ -145,5 +212,5 @@ func ExtractArchive(cacheBody io.Reader, destDir string) ([]string, error) {
 		}
 	}
 
-	return writtenFiles, nil
+	return writtenFiles, manifest, nil
 }
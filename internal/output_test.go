@@ -0,0 +1,78 @@
+package internal_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/simse/ccmd/internal"
+)
+
+func TestArchiveManifestRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "out.txt"), []byte("generated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	archive, err := internal.CaptureOutput([]string{filepath.Join(src, "out.txt")}, &internal.Manifest{
+		Command:   "lint",
+		ExitCode:  2,
+		CreatedAt: created,
+		ExpiresAt: created.Add(time.Hour),
+		Log:       []byte("line one\nline two\n"),
+	}, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	files, manifest, err := internal.ExtractArchive(archive, dest)
+	if err != nil {
+		t.Fatalf("ExtractArchive returned error: %v", err)
+	}
+
+	if len(files) != 1 || filepath.Base(files[0]) != "out.txt" {
+		t.Errorf("extracted files = %v; want only out.txt", files)
+	}
+	if _, err := os.Stat(filepath.Join(dest, internal.MetadataDir)); !os.IsNotExist(err) {
+		t.Errorf("metadata directory was extracted into the working directory")
+	}
+
+	if manifest == nil {
+		t.Fatal("manifest is nil")
+	}
+	if manifest.Command != "lint" || manifest.ExitCode != 2 {
+		t.Errorf("manifest = %+v", manifest)
+	}
+	if string(manifest.Log) != "line one\nline two\n" {
+		t.Errorf("log = %q", manifest.Log)
+	}
+	if manifest.Expired(created.Add(time.Minute)) {
+		t.Errorf("manifest expired before its TTL")
+	}
+	if !manifest.Expired(created.Add(2 * time.Hour)) {
+		t.Errorf("manifest did not expire after its TTL")
+	}
+}
+
+func TestExtractArchiveWithoutManifest(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := internal.CreateArchive([]string{filepath.Join(src, "a.txt")}, nil, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, manifest, err := internal.ExtractArchive(archive, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest != nil {
+		t.Errorf("manifest = %+v; want nil", manifest)
+	}
+}
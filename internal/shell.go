@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// SplitCommand splits a command line into argv using POSIX shell quoting
+// rules: single quotes are literal, double quotes allow backslash escapes of
+// `"`, `\`, `$` and “`”, and a backslash outside quotes escapes the next
+// character. No expansion of any kind is performed, use --shell for that.
+func SplitCommand(command string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inWord  bool
+	)
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, current.String())
+				current.Reset()
+				inWord = false
+			}
+
+		case r == '\\':
+			inWord = true
+			i++
+			if i == len(runes) {
+				return nil, errors.New("trailing backslash in command")
+			}
+			// an escaped newline is a line continuation
+			if runes[i] != '\n' {
+				current.WriteRune(runes[i])
+			}
+
+		case r == '\'':
+			inWord = true
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote in command")
+			}
+			current.WriteString(string(runes[i+1 : end]))
+			i = end
+
+		case r == '"':
+			inWord = true
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`\n", runes[i+1]) {
+					i++
+					if runes[i] == '\n' {
+						continue
+					}
+				}
+				current.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, errors.New("unterminated double quote in command")
+			}
+
+		default:
+			inWord = true
+			current.WriteRune(r)
+		}
+	}
+
+	if inWord {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+// ShellCommand returns the argv that runs command through the user's shell,
+// falling back to /bin/sh (or cmd.exe on Windows).
+func ShellCommand(command string) []string {
+	if runtime.GOOS == "windows" {
+		return []string{"cmd.exe", "/C", command}
+	}
+
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+
+	return []string{shell, "-c", command}
+}
+
+func indexRune(runes []rune, from int, r rune) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,57 @@
+package internal_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/simse/ccmd/internal"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		want    []string
+		wantErr bool
+	}{
+		{"simple", "go build ./...", []string{"go", "build", "./..."}, false},
+		{"extra whitespace", "  a \t b\n c ", []string{"a", "b", "c"}, false},
+		{"empty", "", nil, false},
+		{"single quotes", `sh -c 'a && b'`, []string{"sh", "-c", "a && b"}, false},
+		{"single quotes are literal", `echo 'a\"b $HOME'`, []string{"echo", `a\"b $HOME`}, false},
+		{"double quotes", `echo "hello world"`, []string{"echo", "hello world"}, false},
+		{"double quote escapes", `echo "a \"b\" \$c \d"`, []string{"echo", `a "b" $c \d`}, false},
+		{"backslash escapes", `echo a\ b \'c`, []string{"echo", "a b", "'c"}, false},
+		{"adjacent quotes join", `echo "a"'b'c`, []string{"echo", "abc"}, false},
+		{"empty quoted argument", `printf '' ""`, []string{"printf", "", ""}, false},
+		{"line continuation", "make \\\nall", []string{"make", "all"}, false},
+		{"no expansion", `ls *.go $HOME`, []string{"ls", "*.go", "$HOME"}, false},
+
+		{"unterminated single", `echo 'abc`, nil, true},
+		{"unterminated double", `echo "abc`, nil, true},
+		{"trailing backslash", `echo abc\`, nil, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := internal.SplitCommand(tc.command)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("SplitCommand(%q) err=%v, wantErr=%v", tc.command, err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("SplitCommand(%q) = %q; want %q", tc.command, got, tc.want)
+			}
+		})
+	}
+}
+
+func FuzzSplitCommand(f *testing.F) {
+	f.Add(`sh -c 'a && b'`)
+	f.Add(`echo "a \"b\""`)
+	f.Add(`a\ b`)
+
+	f.Fuzz(func(t *testing.T, command string) {
+		// Just make sure we never panic or hang
+		_, _ = internal.SplitCommand(command)
+	})
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type FileState struct {
+	Size    int64
+	ModTime time.Time
+	Mode    fs.FileMode
+}
+
+func (f FileState) Equal(other FileState) bool {
+	return f.Size == other.Size && f.ModTime.Equal(other.ModTime) && f.Mode == other.Mode
+}
+
+// Snapshot records the state of every file in a tree, by path relative to
+// its root.
+type Snapshot map[string]FileState
+
+// SnapshotTree records the size, modification time and mode of every file
+// under rootDir. Like FindFiles it skips node_modules, and .git is skipped
+// too since it is never an output.
+func SnapshotTree(rootDir string) (Snapshot, error) {
+	snapshot := make(Snapshot)
+
+	walkFn := func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if d.Name() == "node_modules" || d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			// removed while walking
+			return nil
+		}
+
+		rel, err := filepath.Rel(rootDir, path)
+		if err != nil {
+			return err
+		}
+
+		snapshot[filepath.ToSlash(rel)] = FileState{
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Mode:    info.Mode(),
+		}
+		return nil
+	}
+
+	if err := filepath.WalkDir(rootDir, walkFn); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// Changes returns the files that were created or modified between s and
+// after, sorted. Deleted files are not included.
+func (s Snapshot) Changes(after Snapshot) []string {
+	var changed []string
+
+	for path, state := range after {
+		if prev, ok := s[path]; !ok || !prev.Equal(state) {
+			changed = append(changed, path)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,70 @@
+package internal_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/simse/ccmd/internal"
+)
+
+func TestSnapshotChanges(t *testing.T) {
+	root := t.TempDir()
+	createTree(t, root, []string{
+		"unchanged.txt", "modified.txt", "deleted.txt", "touched.txt",
+		"node_modules/pkg/index.js", ".git/HEAD",
+	})
+
+	before, err := internal.SnapshotTree(root)
+	if err != nil {
+		t.Fatalf("SnapshotTree returned error: %v", err)
+	}
+	if _, ok := before["node_modules/pkg/index.js"]; ok {
+		t.Errorf("snapshot includes node_modules")
+	}
+
+	write := func(rel, content string) {
+		t.Helper()
+		full := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("modified.txt", "new content")
+	write("created/new.txt", "new")
+	write("node_modules/pkg/index.js", "ignored")
+	write(".git/HEAD", "ignored")
+	if err := os.Remove(filepath.Join(root, "deleted.txt")); err != nil {
+		t.Fatal(err)
+	}
+	// same size, new modification time
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "touched.txt"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := internal.SnapshotTree(root)
+	if err != nil {
+		t.Fatalf("SnapshotTree returned error: %v", err)
+	}
+
+	want := []string{"created/new.txt", "modified.txt", "touched.txt"}
+	if got := before.Changes(after); !reflect.DeepEqual(got, want) {
+		t.Errorf("Changes = %v; want %v", got, want)
+	}
+}
+
+func TestUnmatched(t *testing.T) {
+	paths := []string{"dist/a.js", "dist/sub/b.js", "coverage/lcov.info", "out.txt"}
+
+	got := internal.Unmatched(paths, []string{"dist/**", "out.txt"})
+	if want := []string{"coverage/lcov.info"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmatched = %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,324 @@
+//go:build linux
+
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ptraceGetSyscallInfo = 0x420e
+	ptraceOExitKill      = 0x100000
+
+	syscallInfoEntry = 1
+	syscallInfoExit  = 2
+
+	atFdCwd    = -100
+	sysOpenat2 = 437
+	oPath      = 0x200000
+)
+
+// syscallInfo mirrors struct ptrace_syscall_info. Data holds the syscall
+// number and arguments on entry, and the return value on exit.
+type syscallInfo struct {
+	Op   uint8
+	_    [3]uint8
+	Arch uint32
+	IP   uint64
+	SP   uint64
+	Data [7]uint64
+	_    uint32
+}
+
+// openSyscall describes where a syscall that opens files keeps its arguments.
+type openSyscall struct {
+	dirfd int // -1 if paths are relative to the working directory
+	path  int
+	flags int
+	how   bool // flags is a pointer to struct open_how
+}
+
+var openSyscalls = map[uint64]openSyscall{
+	syscall.SYS_OPENAT: {dirfd: 0, path: 1, flags: 2},
+	sysOpenat2:         {dirfd: 0, path: 1, flags: 2, how: true},
+}
+
+// fileTracer follows a process tree with ptrace and reports every file it
+// opens for reading. Tracing ends once every traced process has exited, so
+// the tracer also waits for processes left running in the background.
+type fileTracer struct {
+	pid    int
+	onRead func(path string)
+	result chan traceResult
+
+	// open calls that have entered but not yet returned, by thread
+	pending map[int]string
+	// threads that have been seen, so their initial SIGSTOP is not passed on
+	seen map[int]bool
+}
+
+type traceResult struct {
+	exitCode int
+	signal   syscall.Signal
+	err      error
+}
+
+// startTraced runs start with tracing enabled and returns once the command
+// has started. ptrace requests must all come from the thread that started
+// the tracee, so the tracer gets an OS thread of its own.
+func startTraced(cmd *exec.Cmd, start func() error, onRead func(string)) (*fileTracer, error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Ptrace = true
+
+	t := &fileTracer{
+		onRead:  onRead,
+		result:  make(chan traceResult, 1),
+		pending: make(map[int]string),
+		seen:    make(map[int]bool),
+	}
+	started := make(chan error, 1)
+
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		if err := start(); err != nil {
+			started <- err
+			return
+		}
+
+		t.pid = cmd.Process.Pid
+		t.seen[t.pid] = true
+
+		err := t.attach()
+		started <- nil
+
+		if err != nil {
+			// nothing can resume the command without the tracer
+			cmd.Process.Kill()
+			t.result <- traceResult{err: err}
+			return
+		}
+
+		t.result <- t.run()
+	}()
+
+	if err := <-started; err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *fileTracer) wait() (int, syscall.Signal, error) {
+	result := <-t.result
+	return result.exitCode, result.signal, result.err
+}
+
+// attach sets up the command, which is stopped right after exec.
+func (t *fileTracer) attach() error {
+	var status syscall.WaitStatus
+	if _, err := syscall.Wait4(t.pid, &status, syscall.WALL, nil); err != nil {
+		return fmt.Errorf("wait for traced command: %w", err)
+	}
+
+	options := syscall.PTRACE_O_TRACESYSGOOD |
+		syscall.PTRACE_O_TRACEFORK |
+		syscall.PTRACE_O_TRACEVFORK |
+		syscall.PTRACE_O_TRACECLONE |
+		syscall.PTRACE_O_TRACEEXEC |
+		ptraceOExitKill
+
+	if err := syscall.PtraceSetOptions(t.pid, options); err != nil {
+		return fmt.Errorf("ptrace: %w", err)
+	}
+
+	// check that the kernel can describe syscalls (Linux 5.3+)
+	var info syscallInfo
+	if err := getSyscallInfo(t.pid, &info); err != nil {
+		return fmt.Errorf("tracing requires PTRACE_GET_SYSCALL_INFO (Linux 5.3 or newer): %w", err)
+	}
+
+	return syscall.PtraceSyscall(t.pid, 0)
+}
+
+func (t *fileTracer) run() traceResult {
+	var result traceResult
+
+	for {
+		var status syscall.WaitStatus
+		tid, err := syscall.Wait4(-1, &status, syscall.WALL, nil)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if errors.Is(err, syscall.ECHILD) {
+			// every traced process has exited
+			return result
+		}
+		if err != nil {
+			result.err = err
+			return result
+		}
+
+		switch {
+		case status.Exited() || status.Signaled():
+			delete(t.pending, tid)
+
+			if tid == t.pid {
+				if status.Signaled() {
+					result.signal = status.Signal()
+					result.exitCode = 128 + int(result.signal)
+				} else {
+					result.exitCode = status.ExitStatus()
+				}
+			}
+			continue
+
+		case !status.Stopped():
+			continue
+		}
+
+		// errors from here on mean the thread has gone away, which the next
+		// wait reports
+		switch sig := status.StopSignal(); {
+		case sig == syscall.SIGTRAP|0x80:
+			t.handleSyscall(tid)
+			syscall.PtraceSyscall(tid, 0)
+
+		case sig == syscall.SIGTRAP && status.TrapCause() != 0:
+			// fork, clone or exec
+			if status.TrapCause() == syscall.PTRACE_EVENT_EXEC {
+				delete(t.pending, tid)
+			}
+			syscall.PtraceSyscall(tid, 0)
+
+		case sig == syscall.SIGSTOP && !t.seen[tid]:
+			// new processes and threads start with a SIGSTOP of their own
+			t.seen[tid] = true
+			syscall.PtraceSyscall(tid, 0)
+
+		default:
+			// a real signal, deliver it
+			t.seen[tid] = true
+			syscall.PtraceSyscall(tid, int(sig))
+		}
+	}
+}
+
+func (t *fileTracer) handleSyscall(tid int) {
+	var info syscallInfo
+	if err := getSyscallInfo(tid, &info); err != nil {
+		return
+	}
+
+	switch info.Op {
+	case syscallInfoEntry:
+		call, ok := openSyscalls[info.Data[0]]
+		if !ok {
+			return
+		}
+
+		if path, ok := t.readOpen(tid, call, info.Data[1:]); ok {
+			t.pending[tid] = path
+		}
+
+	case syscallInfoExit:
+		path, ok := t.pending[tid]
+		if !ok {
+			return
+		}
+		delete(t.pending, tid)
+
+		// a negative return value is an errno
+		if int64(info.Data[0]) >= 0 {
+			t.onRead(path)
+		}
+	}
+}
+
+// readOpen returns the absolute path being opened, if it is opened for reading.
+func (t *fileTracer) readOpen(tid int, call openSyscall, args []uint64) (string, bool) {
+	flags := args[call.flags]
+	if call.how {
+		var how [8]byte
+		if n, err := syscall.PtracePeekData(tid, uintptr(flags), how[:]); err != nil || n != len(how) {
+			return "", false
+		}
+		flags = binary.NativeEndian.Uint64(how[:])
+	}
+
+	if flags&syscall.O_ACCMODE == syscall.O_WRONLY || flags&oPath != 0 {
+		return "", false
+	}
+
+	path, err := readString(tid, uintptr(args[call.path]))
+	if err != nil || path == "" {
+		return "", false
+	}
+
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path), true
+	}
+
+	// relative paths are resolved against the thread's working directory
+	// or the directory the dirfd refers to
+	base := fmt.Sprintf("/proc/%d/cwd", tid)
+	if call.dirfd >= 0 && int32(args[call.dirfd]) != atFdCwd {
+		base = fmt.Sprintf("/proc/%d/fd/%d", tid, int32(args[call.dirfd]))
+	}
+
+	dir, err := os.Readlink(base)
+	if err != nil {
+		return "", false
+	}
+
+	return filepath.Join(dir, path), true
+}
+
+// readString reads a NUL terminated string from the memory of a tracee.
+func readString(tid int, addr uintptr) (string, error) {
+	var buf []byte
+	chunk := make([]byte, 256)
+
+	for len(buf) < syscall.PathMax {
+		n, err := syscall.PtracePeekData(tid, addr+uintptr(len(buf)), chunk)
+		if i := bytes.IndexByte(chunk[:n], 0); i >= 0 {
+			return string(append(buf, chunk[:i]...)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if n == 0 {
+			break
+		}
+		buf = append(buf, chunk[:n]...)
+	}
+
+	return "", errors.New("path is not terminated")
+}
+
+func getSyscallInfo(tid int, info *syscallInfo) error {
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_PTRACE,
+		ptraceGetSyscallInfo,
+		uintptr(tid),
+		unsafe.Sizeof(*info),
+		uintptr(unsafe.Pointer(info)),
+		0, 0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
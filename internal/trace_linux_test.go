@@ -0,0 +1,67 @@
+package internal_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/simse/ccmd/internal"
+)
+
+func TestRunCommandTraceReads(t *testing.T) {
+	dir := t.TempDir()
+	createTree(t, dir, []string{"a.txt", "sub/b.txt", "sub/c.txt", "unread.txt"})
+
+	var (
+		mu    sync.Mutex
+		reads = map[string]bool{}
+	)
+
+	// reads from the script itself, a child, a background grandchild and a
+	// relative path from another directory; writes must not be reported
+	err := internal.RunCommand(writeScript(t, dir, `cat a.txt > /dev/null
+(cd sub && cat b.txt > /dev/null)
+sh -c 'cat sub/c.txt > /dev/null' &
+wait
+cat does-not-exist.txt 2> /dev/null
+echo out > written.txt`), internal.CommandOptions{
+		WorkingDirectory: dir,
+		TraceReads: func(path string) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if rel, err := filepath.Rel(dir, path); err == nil && filepath.IsLocal(rel) {
+				reads[rel] = true
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("RunCommand returned error: %v", err)
+	}
+
+	var got []string
+	for rel := range reads {
+		got = append(got, rel)
+	}
+	sort.Strings(got)
+
+	// the script itself is read by the shell
+	want := []string{"a.txt", "script.sh", "sub/b.txt", "sub/c.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("traced reads = %v; want %v", got, want)
+	}
+}
+
+func TestRunCommandTraceExitCode(t *testing.T) {
+	dir := t.TempDir()
+
+	err := internal.RunCommand(writeScript(t, dir, "exit 3"), internal.CommandOptions{
+		WorkingDirectory: dir,
+		TraceReads:       func(string) {},
+	})
+	if internal.ExitCode(err) != 3 {
+		t.Errorf("err = %v; want exit code 3", err)
+	}
+}
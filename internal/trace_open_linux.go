@@ -0,0 +1,10 @@
+//go:build linux && (386 || amd64 || arm)
+
+package internal
+
+import "syscall"
+
+// newer architectures only have openat
+func init() {
+	openSyscalls[syscall.SYS_OPEN] = openSyscall{dirfd: -1, path: 0, flags: 1}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+type fileTracer struct{}
+
+func startTraced(cmd *exec.Cmd, start func() error, onRead func(string)) (*fileTracer, error) {
+	return nil, errors.New("tracing file accesses is only supported on Linux")
+}
+
+func (t *fileTracer) wait() (int, syscall.Signal, error) {
+	return 0, 0, errors.New("tracing file accesses is only supported on Linux")
+}
@@ -1,6 +1,11 @@
 package internal
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
 
 func ByteCountSI(b int64) string {
 	const unit = 1000
@@ -29,3 +34,53 @@ func ByteCountIEC(b int64) string {
 	return fmt.Sprintf("%.1f %ciB",
 		float64(b)/float64(div), "KMGTPE"[exp])
 }
+
+// ByteSize is a size given on the command line, e.g. "500MB" or "2GiB".
+type ByteSize int64
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"KB":  1000,
+	"MB":  1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+
+	unit, ok := byteUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return fmt.Errorf("unknown unit in size %q", s)
+	}
+
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+
+	*b = ByteSize(n * float64(unit))
+	return nil
+}
+
+// CountingReader counts the bytes read through it, for backends whose uploads
+// do not report their size.
+type CountingReader struct {
+	Reader    io.Reader
+	ByteCount int64
+}
+
+func (c *CountingReader) Read(p []byte) (int, error) {
+	nn, err := c.Reader.Read(p)
+	c.ByteCount += int64(nn)
+	return nn, err
+}
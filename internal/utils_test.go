@@ -0,0 +1,37 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/simse/ccmd/internal"
+)
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    internal.ByteSize
+		wantErr bool
+	}{
+		{"1024", 1024, false},
+		{"500MB", 500_000_000, false},
+		{"2 GiB", 2 << 30, false},
+		{"1.5kb", 1500, false},
+
+		{"", 0, true},
+		{"10XB", 0, true},
+		{"-1GB", 0, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			var got internal.ByteSize
+			err := got.UnmarshalText([]byte(tc.in))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("UnmarshalText(%q) err=%v, wantErr=%v", tc.in, err, tc.wantErr)
+			}
+			if !tc.wantErr && got != tc.want {
+				t.Errorf("UnmarshalText(%q) = %d; want %d", tc.in, got, tc.want)
+			}
+		})
+	}
+}
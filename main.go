@@ -1,9 +1,6 @@
 package main
 
 import (
-	"fmt"
-
-	"github.com/alexflint/go-arg"
 	"github.com/simse/ccmd/commands"
 )
 
@@ -13,29 +10,9 @@ var (
 	date    = "unknown"
 )
 
-type args struct {
-	CacheList *commands.CacheListCmd   `arg:"subcommand:cache-list"`
-	Run       *commands.RunCommandArgs `arg:"subcommand:run"`
-}
-
-func (args) Version() string {
-	return fmt.Sprintf("ccmd %s", version)
-}
-
 func main() {
-	var args args
-
-	arg.MustParse(&args)
-
-	switch {
-	case args.Run != nil:
-		commands.RunCommand(args.Run, commands.RuntimeInformation{
-			Version: version,
-			Commit:  commit,
-		})
-		return
-	case args.CacheList != nil:
-		commands.CacheListCommand()
-		return
-	}
+	commands.Main(commands.RuntimeInformation{
+		Version: version,
+		Commit:  commit,
+	})
 }